@@ -17,6 +17,7 @@ import (
 	"github.com/torilabs/mqtt-prometheus-exporter/log"
 	"github.com/torilabs/mqtt-prometheus-exporter/mqtt"
 	"github.com/torilabs/mqtt-prometheus-exporter/prometheus"
+	"github.com/torilabs/mqtt-prometheus-exporter/sparkplug"
 	"go.uber.org/zap"
 	"gopkg.in/validator.v2"
 )
@@ -76,13 +77,41 @@ var rootCmd = &cobra.Command{
 		defer l.Close()
 		checkers = append(checkers, healthcheck.WithChecker("MQTT", l))
 
-		cl := prometheus.NewCollector(cfg.Cache.Expiration, cfg.Metrics)
+		derived := make([]*prometheus.DerivedMetric, 0, len(cfg.Derived))
+		for _, d := range cfg.Derived {
+			dm, err := prometheus.NewDerivedMetric(d)
+			if err != nil {
+				return err
+			}
+			derived = append(derived, dm)
+		}
+		opts := []prometheus.CollectorOption{
+			prometheus.WithAggregates(cfg.Aggregates),
+			prometheus.WithDerivedMetrics(derived...),
+			prometheus.WithDevices(cfg.Devices),
+			prometheus.WithSnapshot(cfg.Snapshot),
+		}
+		if len(cfg.Availability) > 0 {
+			opts = append(opts, prometheus.WithAvailability())
+		}
+		cl := prometheus.NewCollector(cfg.Cache.Expiration, cfg.Metrics, opts...)
+		defer func() {
+			if err := cl.Close(); err != nil {
+				log.Logger.With(zap.Error(err)).Warnf("Writing of snapshot failed.")
+			}
+		}()
 
 		topicHandlers := make(map[string][]pahomqtt.MessageHandler)
 		for _, m := range cfg.Metrics {
-			mh := mqtt.NewMessageHandler(m, cl)
+			mh, err := mqtt.NewMessageHandler(m, cl)
+			if err != nil {
+				return err
+			}
 			topicHandlers[m.MqttTopic] = append(topicHandlers[m.MqttTopic], mh)
 		}
+		for _, a := range cfg.Availability {
+			topicHandlers[a.MqttTopic] = append(topicHandlers[a.MqttTopic], mqtt.NewAvailabilityHandler(a, cl))
+		}
 
 		for topic, handlers := range topicHandlers {
 			var handler pahomqtt.MessageHandler
@@ -99,6 +128,16 @@ var rootCmd = &cobra.Command{
 		if err := prom.Register(cl); err != nil {
 			return err
 		}
+
+		if cfg.Sparkplug.Enabled {
+			sp := sparkplug.NewCollector(cfg.Sparkplug)
+			if err := l.Subscribe(sparkplug.Topic(cfg.Sparkplug.GroupID), sp.Handle); err != nil {
+				return err
+			}
+			if err := prom.Register(sp); err != nil {
+				return err
+			}
+		}
 		startServer(checkers)
 
 		// wait for program to terminate
@@ -120,7 +159,8 @@ func startServer(checkers []healthcheck.Option) {
 
 	go func() {
 		http.Handle("/healthcheck", healthcheck.Handler(checkers...))
-		http.Handle("/metrics", promhttp.Handler())
+		gatherer := prometheus.NewCachedGatherer(prom.DefaultGatherer, cfg.Server.ScrapeCache)
+		http.Handle("/metrics", promhttp.InstrumentMetricHandler(prom.DefaultRegisterer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})))
 		if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Server.Port), nil); err != nil && err != http.ErrServerClosed {
 			log.Logger.With(zap.Error(err)).Fatalf("Failed to start admin server.")
 		}
@@ -3,8 +3,10 @@ package config
 import (
 	"fmt"
 	"sort"
+	"strings"
 	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
 )
@@ -24,6 +26,78 @@ func (tl TopicLabels) KeysInOrder() []string {
 	return keys
 }
 
+// JSONLabels maps label names to field paths in decoded payload.
+type JSONLabels map[string]string
+
+// KeysInOrder sort keys always the same way.
+func (jl JSONLabels) KeysInOrder() []string {
+	keys := make([]string, len(jl))
+	i := 0
+	for k := range jl {
+		keys[i] = k
+		i++
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// BitFlags maps flag names to bit positions in a status word.
+type BitFlags map[string]int
+
+// KeysInOrder sort keys always the same way.
+func (bf BitFlags) KeysInOrder() []string {
+	keys := make([]string, len(bf))
+	i := 0
+	for k := range bf {
+		keys[i] = k
+		i++
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// BinaryField describes position and encoding of a value in binary payload.
+type BinaryField struct {
+	Offset    int     `mapstructure:"offset"`
+	Length    int     `mapstructure:"length"`
+	ByteOrder string  `mapstructure:"byte_order"`
+	Signed    bool    `mapstructure:"signed"`
+	Type      string  `mapstructure:"type"`
+	Scale     float64 `mapstructure:"scale"`
+}
+
+// Expiration is time after which series not observed again are removed.
+type Expiration time.Duration
+
+// NeverExpire keeps series until the exporter restarts.
+const NeverExpire Expiration = -1
+
+// UnmarshalText decodes duration or "never".
+func (e *Expiration) UnmarshalText(text []byte) error {
+	if strings.EqualFold(string(text), "never") {
+		*e = NeverExpire
+		return nil
+	}
+	d, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid expiration '%s': %w", text, err)
+	}
+	*e = Expiration(d)
+	return nil
+}
+
+// Objective is a summary quantile with its allowed absolute error.
+type Objective struct {
+	Quantile float64 `mapstructure:"quantile"`
+	Error    float64 `mapstructure:"error"`
+}
+
+// Aggregation is a set of functions of values received within the sliding window.
+type Aggregation struct {
+	Window    time.Duration `mapstructure:"window" validate:"nonzero"`
+	Functions []string      `mapstructure:"functions"`
+}
+
 // Logger configuration structure.
 type Logger struct {
 	Level           string
@@ -33,6 +107,8 @@ type Logger struct {
 // Server configuration structure.
 type Server struct {
 	Port int
+	// ScrapeCache is time gathered metrics are reused by following scrapes, zero disables the cache
+	ScrapeCache time.Duration `mapstructure:"scrape_cache"`
 }
 
 // MQTT configuration structure.
@@ -49,29 +125,165 @@ type Cache struct {
 	Expiration time.Duration `mapstructure:"expiration"`
 }
 
+// Snapshot configuration structure.
+type Snapshot struct {
+	Path     string        `mapstructure:"path"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// Sparkplug configuration structure.
+type Sparkplug struct {
+	Enabled bool              `mapstructure:"enabled"`
+	GroupID string            `mapstructure:"group_id"`
+	Prefix  string            `mapstructure:"prefix" validate:"regexp=^[a-zA-Z_:]([a-zA-Z0-9_:])*$"`
+	Types   map[string]string `mapstructure:"types"`
+}
+
+// Devices configuration structure.
+type Devices struct {
+	Enabled   bool          `mapstructure:"enabled"`
+	Label     string        `mapstructure:"label" validate:"regexp=^[a-zA-Z_][a-zA-Z0-9_]*$"`
+	Timeout   time.Duration `mapstructure:"timeout"`
+	Retention time.Duration `mapstructure:"retention"`
+	Expected  []string      `mapstructure:"expected"`
+}
+
+// Availability is a topic devices publish their online state to, e.g. as their last will.
+type Availability struct {
+	MqttTopic    string `mapstructure:"mqtt_topic" validate:"nonzero"`
+	DeviceIndex  int    `mapstructure:"device_index"`
+	Online       string `mapstructure:"payload_online"`
+	Offline      string `mapstructure:"payload_offline"`
+	RemoveSeries bool   `mapstructure:"remove_series"`
+}
+
 // Metric is a mapping between a metric send on mqtt to a prometheus metric.
 type Metric struct {
 	PrometheusName string            `mapstructure:"prom_name" validate:"nonzero,regexp=^[a-zA-Z_:]([a-zA-Z0-9_:])*$"`
 	MqttTopic      string            `mapstructure:"mqtt_topic" validate:"nonzero"`
 	Help           string            `mapstructure:"help"`
 	MetricType     string            `mapstructure:"type"`
+	CounterMode    string            `mapstructure:"counter_mode" validate:"regexp=^(|raw|cumulative|delta)$"`
+	Buckets        []float64         `mapstructure:"buckets"`
+	NativeFactor   float64           `mapstructure:"native_histogram_bucket_factor"`
+	Objectives     []Objective       `mapstructure:"objectives"`
+	MaxAge         time.Duration     `mapstructure:"max_age"`
+	Preaggregated  bool              `mapstructure:"preaggregated"`
+	Aggregations   []Aggregation     `mapstructure:"aggregations"`
+	TrackChanges   bool              `mapstructure:"track_changes"`
+	TrackStates    bool              `mapstructure:"track_states"`
+	Expiration     Expiration        `mapstructure:"expiration"`
 	ConstantLabels prometheus.Labels `mapstructure:"const_labels"`
 	TopicLabels    TopicLabels       `mapstructure:"topic_labels"`
+	PayloadFormat  string            `mapstructure:"payload_format"`
+	PayloadEnc     string            `mapstructure:"payload_encoding"`
 	JSONField      string            `mapstructure:"json_field"`
+	JSONLabels     JSONLabels        `mapstructure:"json_labels"`
+	TimestampField string            `mapstructure:"timestamp_field"`
+	TimestampFmt   string            `mapstructure:"timestamp_format"`
+	TimestampTol   time.Duration     `mapstructure:"timestamp_tolerance"`
+	TimestampMode  string            `mapstructure:"timestamp" validate:"regexp=^(|message|payload|none)$"`
+	BinaryField    *BinaryField      `mapstructure:"binary_field"`
+	BitFlags       BitFlags          `mapstructure:"bit_flags"`
+	LenientParsing bool              `mapstructure:"lenient_parsing"`
+	UnitLabel      string            `mapstructure:"unit_label" validate:"regexp=^([a-zA-Z_][a-zA-Z0-9_]*)?$"`
+	ProtoDescSet   string            `mapstructure:"proto_descriptor_set"`
+	ProtoMessage   string            `mapstructure:"proto_message"`
+	ValueExpr      string            `mapstructure:"value_expr"`
+	FilterExpr     string            `mapstructure:"filter_expr"`
+}
+
+// Aggregate is a metric computed across live series of another metric.
+type Aggregate struct {
+	PrometheusName string            `mapstructure:"prom_name" validate:"nonzero,regexp=^[a-zA-Z_:]([a-zA-Z0-9_:])*$"`
+	Help           string            `mapstructure:"help"`
+	Source         string            `mapstructure:"source" validate:"nonzero"`
+	Function       string            `mapstructure:"function" validate:"regexp=^(sum|avg|min|max|count)$"`
+	GroupBy        []string          `mapstructure:"group_by"`
+	ConstantLabels prometheus.Labels `mapstructure:"const_labels"`
+}
+
+// PrometheusDescription constructs description of aggregate labeled by group_by labels.
+func (a *Aggregate) PrometheusDescription() *prometheus.Desc {
+	return prometheus.NewDesc(
+		a.PrometheusName, a.Help, a.GroupBy, a.ConstantLabels,
+	)
+}
+
+// Derived is a metric computed by formula over other metrics joined on shared labels,
+// or a per-second rate or derivative of the source metric between consecutive messages.
+type Derived struct {
+	PrometheusName string            `mapstructure:"prom_name" validate:"nonzero,regexp=^[a-zA-Z_:]([a-zA-Z0-9_:])*$"`
+	Help           string            `mapstructure:"help"`
+	Function       string            `mapstructure:"function" validate:"regexp=^(|formula|rate|deriv)$"`
+	Inputs         map[string]string `mapstructure:"inputs"`
+	Source         string            `mapstructure:"source"`
+	MinInterval    time.Duration     `mapstructure:"min_interval"`
+	Formula        string            `mapstructure:"formula"`
+	JoinOn         []string          `mapstructure:"join_on"`
+	ConstantLabels prometheus.Labels `mapstructure:"const_labels"`
+}
+
+// IsRate checks if derived metric is computed between consecutive messages of the source metric.
+func (d *Derived) IsRate() bool {
+	return d.Function == "rate" || d.Function == "deriv"
+}
+
+// PrometheusDescription constructs description of derived metric labeled by join_on labels.
+func (d *Derived) PrometheusDescription() *prometheus.Desc {
+	return prometheus.NewDesc(
+		d.PrometheusName, d.Help, d.JoinOn, d.ConstantLabels,
+	)
 }
 
 // PrometheusDescription constructs description.
 func (m *Metric) PrometheusDescription() *prometheus.Desc {
+	return prometheus.NewDesc(
+		m.PrometheusName, m.Help, m.VariableLabels(), m.ConstantLabels,
+	)
+}
+
+// VariableLabels returns label names in the order of label values passed to the collector.
+func (m *Metric) VariableLabels() []string {
 	varLabels := []string{"topic"}
 	varLabels = append(varLabels, m.TopicLabels.KeysInOrder()...)
+	varLabels = append(varLabels, m.JSONLabels.KeysInOrder()...)
+	if m.UnitLabel != "" {
+		varLabels = append(varLabels, m.UnitLabel)
+	}
+	if len(m.BitFlags) > 0 {
+		varLabels = append(varLabels, "flag")
+	}
+	return varLabels
+}
 
-	return prometheus.NewDesc(
-		m.PrometheusName, m.Help, varLabels, m.ConstantLabels,
-	)
+// HasWildcardField checks if every numeric field under the json_field path is exported as separate metric.
+func (m *Metric) HasWildcardField() bool {
+	return strings.HasSuffix(m.JSONField, "*")
+}
+
+// TimestampPolicy resolves source of the exposed sample timestamp: "message", "payload" or "none".
+func (m *Metric) TimestampPolicy() string {
+	switch {
+	case m.TimestampMode != "":
+		return m.TimestampMode
+	case m.TimestampField != "":
+		return "payload"
+	default:
+		return "message"
+	}
+}
+
+// IsDistribution checks if received values are observed into histogram or summary.
+func (m *Metric) IsDistribution() bool {
+	return m.MetricType == "histogram" || m.MetricType == "summary"
 }
 
 // PrometheusValueType decodes type of prometheus metric.
 func (m *Metric) PrometheusValueType() prometheus.ValueType {
+	if m.CounterMode == "cumulative" || m.CounterMode == "delta" {
+		return prometheus.CounterValue
+	}
 	switch m.MetricType {
 	case "gauge":
 		return prometheus.GaugeValue
@@ -84,11 +296,17 @@ func (m *Metric) PrometheusValueType() prometheus.ValueType {
 
 // Configuration structure.
 type Configuration struct {
-	Logging Logger
-	Server  Server
-	MQTT    MQTT
-	Metrics []Metric
-	Cache   Cache
+	Logging      Logger
+	Server       Server
+	MQTT         MQTT
+	Metrics      []Metric
+	Aggregates   []Aggregate
+	Derived      []Derived
+	Cache        Cache
+	Snapshot     Snapshot
+	Sparkplug    Sparkplug
+	Devices      Devices
+	Availability []Availability
 }
 
 // Parse and validate viper config.
@@ -99,7 +317,11 @@ func Parse() (cfg Configuration, err error) {
 
 	setDefaults()
 
-	if err := viper.Unmarshal(&cfg); err != nil {
+	if err := viper.Unmarshal(&cfg, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.TextUnmarshallerHookFunc(),
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	))); err != nil {
 		return cfg, fmt.Errorf("failed to deserialize config: %w", err)
 	}
 
@@ -115,4 +337,13 @@ func setDefaults() {
 	viper.SetDefault("mqtt.timeout", "3s")
 
 	viper.SetDefault("cache.expiration", "60s")
+
+	viper.SetDefault("snapshot.interval", "60s")
+
+	viper.SetDefault("sparkplug.group_id", "+")
+	viper.SetDefault("sparkplug.prefix", "sparkplug")
+
+	viper.SetDefault("devices.label", "topic")
+	viper.SetDefault("devices.timeout", "5m")
+	viper.SetDefault("devices.retention", "24h")
 }
@@ -32,6 +32,31 @@ func TestMetric_PrometheusDescription(t *testing.T) {
 			},
 			want: "Desc{fqName: \"name\", help: \"help msg\", constLabels: {const_label=\"label_value\"}, variableLabels: {topic,device}}",
 		},
+		{
+			name: "description with JSON labels",
+			metric: Metric{
+				PrometheusName: "name",
+				Help:           "help msg",
+				TopicLabels: map[string]int{
+					"device": 1,
+				},
+				JSONLabels: map[string]string{
+					"room":  "location.room",
+					"floor": "location.floor",
+				},
+			},
+			want: "Desc{fqName: \"name\", help: \"help msg\", constLabels: {}, variableLabels: {topic,device,floor,room}}",
+		},
+		{
+			name: "description with bit flags",
+			metric: Metric{
+				PrometheusName: "status_flag",
+				BitFlags: map[string]int{
+					"overheat": 0,
+				},
+			},
+			want: "Desc{fqName: \"status_flag\", help: \"\", constLabels: {}, variableLabels: {topic,flag}}",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -62,6 +87,21 @@ func TestMetric_PrometheusValueType(t *testing.T) {
 			},
 			want: prometheus.CounterValue,
 		},
+		{
+			name: "cumulative counter mode",
+			metric: Metric{
+				MetricType:  "gauge",
+				CounterMode: "cumulative",
+			},
+			want: prometheus.CounterValue,
+		},
+		{
+			name: "delta counter mode",
+			metric: Metric{
+				CounterMode: "delta",
+			},
+			want: prometheus.CounterValue,
+		},
 		{
 			name: "other types",
 			metric: Metric{
@@ -79,6 +119,45 @@ func TestMetric_PrometheusValueType(t *testing.T) {
 	}
 }
 
+func TestMetric_HasWildcardField(t *testing.T) {
+	tests := []struct {
+		field string
+		want  bool
+	}{
+		{field: "", want: false},
+		{field: "temperature", want: false},
+		{field: "*", want: true},
+		{field: "fields.*", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			m := Metric{JSONField: tt.field}
+			if got := m.HasWildcardField(); got != tt.want {
+				t.Errorf("HasWildcardField() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetric_TimestampPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric Metric
+		want   string
+	}{
+		{name: "message by default", metric: Metric{}, want: "message"},
+		{name: "payload when field set", metric: Metric{TimestampField: "ts"}, want: "payload"},
+		{name: "explicit policy", metric: Metric{TimestampField: "ts", TimestampMode: "none"}, want: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.metric.TimestampPolicy(); got != tt.want {
+				t.Errorf("TimestampPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestParse(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -103,6 +182,18 @@ func TestParse(t *testing.T) {
 				Cache: Cache{
 					Expiration: time.Second * 60,
 				},
+				Snapshot: Snapshot{
+					Interval: time.Minute,
+				},
+				Sparkplug: Sparkplug{
+					GroupID: "+",
+					Prefix:  "sparkplug",
+				},
+				Devices: Devices{
+					Label:     "topic",
+					Timeout:   5 * time.Minute,
+					Retention: 24 * time.Hour,
+				},
 			},
 		},
 		{
@@ -113,6 +204,7 @@ logging:
   developmentMode: true
 server:
   port: 8077
+  scrape_cache: 5s
 mqtt:
   host: "ws://192.168.1.1"
   port: 9001
@@ -121,6 +213,25 @@ mqtt:
   timeout: 4s
 cache:
   expiration: 100s
+snapshot:
+  path: "/var/lib/exporter/snapshot.json"
+  interval: 30s
+sparkplug:
+  enabled: true
+  group_id: "plant1"
+  prefix: "spb"
+  types:
+    UInt64: counter
+devices:
+  enabled: true
+  label: "device"
+  timeout: 10m
+  retention: 12h
+  expected: ["sensor1", "sensor2"]
+availability:
+  - mqtt_topic: "devices/+/status"
+    device_index: 1
+    remove_series: true
 metrics:
   - mqtt_topic: "/home/+/memory"
     prom_name: "memory"
@@ -134,6 +245,33 @@ metrics:
   - mqtt_topic: "+/home/rpi/#"
     prom_name: "rpi"
     type: "gauge"
+  - mqtt_topic: "/api/latency"
+    prom_name: "latency_seconds"
+    type: "histogram"
+    buckets: [0.1, 0.5, 1]
+    expiration: never
+  - mqtt_topic: "/sensor/noise"
+    prom_name: "noise"
+    type: "summary"
+    objectives:
+      - quantile: 0.5
+        error: 0.05
+      - quantile: 0.99
+        error: 0.001
+    max_age: 5m
+    expiration: 2h
+aggregates:
+  - prom_name: "floor_temperature_avg"
+    source: "temperature"
+    function: "avg"
+    group_by: ["floor"]
+derived:
+  - prom_name: "power_watts"
+    inputs:
+      u: "voltage"
+      i: "current"
+    formula: "u * i"
+    join_on: ["device"]
 `,
 			wantCfg: Configuration{
 				Logging: Logger{
@@ -141,7 +279,8 @@ metrics:
 					DevelopmentMode: true,
 				},
 				Server: Server{
-					Port: 8077,
+					Port:        8077,
+					ScrapeCache: 5 * time.Second,
 				},
 				MQTT: MQTT{
 					Host:     "ws://192.168.1.1",
@@ -153,6 +292,32 @@ metrics:
 				Cache: Cache{
 					Expiration: time.Second * 100,
 				},
+				Snapshot: Snapshot{
+					Path:     "/var/lib/exporter/snapshot.json",
+					Interval: 30 * time.Second,
+				},
+				Sparkplug: Sparkplug{
+					Enabled: true,
+					GroupID: "plant1",
+					Prefix:  "spb",
+					Types: map[string]string{
+						"uint64": "counter",
+					},
+				},
+				Devices: Devices{
+					Enabled:   true,
+					Label:     "device",
+					Timeout:   10 * time.Minute,
+					Retention: 12 * time.Hour,
+					Expected:  []string{"sensor1", "sensor2"},
+				},
+				Availability: []Availability{
+					{
+						MqttTopic:    "devices/+/status",
+						DeviceIndex:  1,
+						RemoveSeries: true,
+					},
+				},
 				Metrics: []Metric{
 					{
 						PrometheusName: "memory",
@@ -172,6 +337,40 @@ metrics:
 						MqttTopic:      "+/home/rpi/#",
 						MetricType:     "gauge",
 					},
+					{
+						PrometheusName: "latency_seconds",
+						MqttTopic:      "/api/latency",
+						MetricType:     "histogram",
+						Buckets:        []float64{0.1, 0.5, 1},
+						Expiration:     NeverExpire,
+					},
+					{
+						PrometheusName: "noise",
+						MqttTopic:      "/sensor/noise",
+						MetricType:     "summary",
+						Objectives: []Objective{
+							{Quantile: 0.5, Error: 0.05},
+							{Quantile: 0.99, Error: 0.001},
+						},
+						MaxAge:     5 * time.Minute,
+						Expiration: Expiration(2 * time.Hour),
+					},
+				},
+				Aggregates: []Aggregate{
+					{
+						PrometheusName: "floor_temperature_avg",
+						Source:         "temperature",
+						Function:       "avg",
+						GroupBy:        []string{"floor"},
+					},
+				},
+				Derived: []Derived{
+					{
+						PrometheusName: "power_watts",
+						Inputs:         map[string]string{"u": "voltage", "i": "current"},
+						Formula:        "u * i",
+						JoinOn:         []string{"device"},
+					},
 				},
 			},
 		},
@@ -275,6 +474,15 @@ func TestMetricValidation(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "invalid metric - unknown timestamp policy",
+			metric: Metric{
+				PrometheusName: "name",
+				MqttTopic:      "/home/+/memory",
+				TimestampMode:  "device",
+			},
+			wantErr: true,
+		},
 		{
 			name: "invalid metric - name starts with number",
 			metric: Metric{
@@ -303,3 +511,28 @@ func TestTopicLabels_KeysInOrder(t *testing.T) {
 		}
 	}
 }
+
+func TestExpiration_UnmarshalText(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    Expiration
+		wantErr bool
+	}{
+		{text: "never", want: NeverExpire},
+		{text: "Never", want: NeverExpire},
+		{text: "90s", want: Expiration(90 * time.Second)},
+		{text: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			var got Expiration
+			err := got.UnmarshalText([]byte(tt.text))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalText() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("UnmarshalText() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
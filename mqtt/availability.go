@@ -0,0 +1,38 @@
+package mqtt
+
+import (
+	"strings"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"github.com/torilabs/mqtt-prometheus-exporter/log"
+	"github.com/torilabs/mqtt-prometheus-exporter/prometheus"
+)
+
+// NewAvailabilityHandler constructs handler of online and offline messages published to availability topic.
+// Device is identified by the topic part at device_index, or by the whole topic when not set.
+func NewAvailabilityHandler(a config.Availability, collector prometheus.Collector) pahomqtt.MessageHandler {
+	online, offline := a.Online, a.Offline
+	if online == "" {
+		online = "online"
+	}
+	if offline == "" {
+		offline = "offline"
+	}
+	return func(_ pahomqtt.Client, msg pahomqtt.Message) {
+		device := msg.Topic()
+		if a.DeviceIndex != 0 {
+			device = getTopicPart(msg.Topic(), a.DeviceIndex)
+		}
+		payload := strings.TrimSpace(string(msg.Payload()))
+		log.Logger.Debugf("Received availability '%s' of '%s' device from '%s' topic.", payload, device, msg.Topic())
+		switch {
+		case strings.EqualFold(payload, online):
+			collector.ObserveAvailability(device, true, a.RemoveSeries)
+		case strings.EqualFold(payload, offline):
+			collector.ObserveAvailability(device, false, a.RemoveSeries)
+		default:
+			log.Logger.Warnf("Got unexpected availability '%s' from '%s' topic.", payload, msg.Topic())
+		}
+	}
+}
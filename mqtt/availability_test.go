@@ -0,0 +1,55 @@
+package mqtt
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+func TestNewAvailabilityHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		availability config.Availability
+		topic        string
+		payload      string
+		want         map[string]bool
+	}{
+		{
+			name:         "online",
+			availability: config.Availability{DeviceIndex: 1},
+			topic:        "devices/plug1/status",
+			payload:      "online",
+			want:         map[string]bool{"plug1": true},
+		},
+		{
+			name:         "offline case insensitive",
+			availability: config.Availability{DeviceIndex: -2},
+			topic:        "devices/plug1/status",
+			payload:      "Offline\n",
+			want:         map[string]bool{"plug1": false},
+		},
+		{
+			name:         "custom payload and whole topic device",
+			availability: config.Availability{Online: "1", Offline: "0"},
+			topic:        "plug1/lwt",
+			payload:      "0",
+			want:         map[string]bool{"plug1/lwt": false},
+		},
+		{
+			name:         "unexpected payload",
+			availability: config.Availability{DeviceIndex: 1},
+			topic:        "devices/plug1/status",
+			payload:      "sleeping",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := fakeCollector{}
+			NewAvailabilityHandler(tt.availability, &collector)(&fakeClient{}, &fakeMessage{topic: tt.topic, payload: []byte(tt.payload)})
+			if !reflect.DeepEqual(collector.obsAvailable, tt.want) {
+				t.Errorf("availability = %v, want %v", collector.obsAvailable, tt.want)
+			}
+		})
+	}
+}
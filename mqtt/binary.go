@@ -0,0 +1,117 @@
+package mqtt
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+// binaryLayout is validated binary field configuration.
+type binaryLayout struct {
+	offset  int
+	length  int
+	order   binary.ByteOrder
+	signed  bool
+	isFloat bool
+	scale   float64
+}
+
+func newBinaryLayout(f *config.BinaryField) (*binaryLayout, error) {
+	if f == nil {
+		return nil, fmt.Errorf("payload format 'binary' requires binary_field")
+	}
+	l := &binaryLayout{
+		offset: f.Offset,
+		length: f.Length,
+		order:  binary.BigEndian,
+		signed: f.Signed,
+		scale:  f.Scale,
+	}
+	if l.offset < 0 {
+		return nil, fmt.Errorf("invalid binary offset '%d'", f.Offset)
+	}
+	switch strings.ToLower(f.ByteOrder) {
+	case "", "big":
+	case "little":
+		l.order = binary.LittleEndian
+	default:
+		return nil, fmt.Errorf("invalid binary byte order '%s'", f.ByteOrder)
+	}
+	switch strings.ToLower(f.Type) {
+	case "", "int":
+		if l.length == 0 {
+			l.length = 1
+		}
+		if l.length != 1 && l.length != 2 && l.length != 4 && l.length != 8 {
+			return nil, fmt.Errorf("invalid binary integer length '%d'", f.Length)
+		}
+	case "float":
+		l.isFloat = true
+		if l.length == 0 {
+			l.length = 4
+		}
+		if l.length != 4 && l.length != 8 {
+			return nil, fmt.Errorf("invalid binary float length '%d'", f.Length)
+		}
+	default:
+		return nil, fmt.Errorf("invalid binary type '%s'", f.Type)
+	}
+	if l.scale == 0 {
+		l.scale = 1
+	}
+	return l, nil
+}
+
+// read decodes value from the frame, failing when the field is out of the frame bounds.
+func (l *binaryLayout) read(frame []byte) (float64, error) {
+	if l.offset+l.length > len(frame) {
+		return 0, fmt.Errorf("field at offset %d with length %d is out of frame of %d bytes", l.offset, l.length, len(frame))
+	}
+	b := frame[l.offset : l.offset+l.length]
+
+	var raw uint64
+	switch l.length {
+	case 1:
+		raw = uint64(b[0])
+	case 2:
+		raw = uint64(l.order.Uint16(b))
+	case 4:
+		raw = uint64(l.order.Uint32(b))
+	case 8:
+		raw = l.order.Uint64(b)
+	}
+
+	var v float64
+	switch {
+	case l.isFloat && l.length == 4:
+		v = float64(math.Float32frombits(uint32(raw)))
+	case l.isFloat:
+		v = math.Float64frombits(raw)
+	case l.signed:
+		// sign extend the value from its length
+		shift := 64 - 8*l.length
+		v = float64(int64(raw<<shift) >> shift)
+	default:
+		v = float64(raw)
+	}
+	return v * l.scale, nil
+}
+
+// decodePayloadEncoding converts text encoded frame into bytes.
+func decodePayloadEncoding(encoding string, payload []byte) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", "raw":
+		return payload, nil
+	case "hex":
+		return hex.DecodeString(strings.TrimSpace(string(payload)))
+	case "base64":
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(payload)))
+	default:
+		return nil, fmt.Errorf("unknown payload encoding '%s'", encoding)
+	}
+}
@@ -0,0 +1,148 @@
+package mqtt
+
+import (
+	"math"
+	"testing"
+
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+func Test_binaryLayout_read(t *testing.T) {
+	frame := []byte{0x01, 0x02, 0xff, 0x38, 0x00, 0xe1, 0x41, 0xac, 0x00, 0x00}
+	tests := []struct {
+		name  string
+		field config.BinaryField
+		want  float64
+	}{
+		{
+			name:  "unsigned byte by default",
+			field: config.BinaryField{Offset: 1},
+			want:  2,
+		},
+		{
+			name:  "int16 big-endian scaled",
+			field: config.BinaryField{Offset: 4, Length: 2, Signed: true, Scale: 0.1},
+			want:  22.5,
+		},
+		{
+			name:  "negative int16 big-endian",
+			field: config.BinaryField{Offset: 2, Length: 2, Signed: true},
+			want:  -200,
+		},
+		{
+			name:  "unsigned int16 big-endian",
+			field: config.BinaryField{Offset: 2, Length: 2},
+			want:  65336,
+		},
+		{
+			name:  "uint16 little-endian",
+			field: config.BinaryField{Offset: 0, Length: 2, ByteOrder: "little"},
+			want:  513,
+		},
+		{
+			name:  "negative int32 little-endian",
+			field: config.BinaryField{Offset: 2, Length: 4, ByteOrder: "little", Signed: true},
+			want:  -520079105,
+		},
+		{
+			name:  "float32 big-endian",
+			field: config.BinaryField{Offset: 6, Type: "float"},
+			want:  21.5,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := newBinaryLayout(&tt.field)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := l.read(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("read() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_binaryLayout_OutOfBounds(t *testing.T) {
+	l, err := newBinaryLayout(&config.BinaryField{Offset: 3, Length: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.read([]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}); err == nil {
+		t.Errorf("read() expected out of bounds error")
+	}
+	if _, err := l.read(nil); err == nil {
+		t.Errorf("read() of empty frame expected error")
+	}
+}
+
+func Test_newBinaryLayout_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		field *config.BinaryField
+	}{
+		{name: "missing field", field: nil},
+		{name: "negative offset", field: &config.BinaryField{Offset: -1}},
+		{name: "invalid byte order", field: &config.BinaryField{ByteOrder: "middle"}},
+		{name: "invalid int length", field: &config.BinaryField{Length: 3}},
+		{name: "invalid float length", field: &config.BinaryField{Type: "float", Length: 2}},
+		{name: "invalid type", field: &config.BinaryField{Type: "string"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newBinaryLayout(tt.field); err == nil {
+				t.Errorf("newBinaryLayout() expected error")
+			}
+		})
+	}
+}
+
+func Test_binaryMessageHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		encoding     string
+		payload      []byte
+		wantObserved bool
+	}{
+		{name: "raw frame", payload: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0xe1}, wantObserved: true},
+		{name: "hex frame", encoding: "hex", payload: []byte("0000000000E1\n"), wantObserved: true},
+		{name: "base64 frame", encoding: "base64", payload: []byte("AAAAAADh"), wantObserved: true},
+		{name: "short frame", payload: []byte{0x00, 0x00, 0x00, 0x00, 0x00}},
+		{name: "invalid hex", encoding: "hex", payload: []byte("zz")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metric := config.Metric{
+				PrometheusName: "lora_temperature",
+				PayloadEnc:     tt.encoding,
+				BinaryField:    &config.BinaryField{Offset: 4, Length: 2, Signed: true, Scale: 0.1},
+			}
+			collector := fakeCollector{}
+			mh, err := NewMessageHandler(metric, &collector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mh(&fakeClient{}, &fakeMessage{topic: "/lora/device", payload: tt.payload})
+			if collector.observed != tt.wantObserved {
+				t.Fatalf("observed = %v, want %v", collector.observed, tt.wantObserved)
+			}
+			if collector.observed && math.Abs(collector.obsValue-22.5) > 1e-9 {
+				t.Errorf("value = %v, want 22.5", collector.obsValue)
+			}
+		})
+	}
+}
+
+func TestNewMessageHandler_InvalidPayloadEncoding(t *testing.T) {
+	metric := config.Metric{
+		PayloadEnc:  "base32",
+		BinaryField: &config.BinaryField{},
+	}
+	if _, err := NewMessageHandler(metric, &fakeCollector{}); err == nil {
+		t.Errorf("NewMessageHandler() expected error")
+	}
+}
@@ -0,0 +1,114 @@
+package mqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-logfmt/logfmt"
+	"github.com/influxdata/line-protocol/v2/lineprotocol"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// payloadDecoder decodes message payload into generic trees of values.
+// Most formats produce a single document, line based formats produce one per line.
+type payloadDecoder func(payload []byte) ([]map[string]interface{}, error)
+
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+}.DecMode()
+
+func decodeJSON(payload []byte) ([]map[string]interface{}, error) {
+	jsonMap := make(map[string]interface{})
+	if err := json.Unmarshal(payload, &jsonMap); err != nil {
+		return nil, err
+	}
+	return []map[string]interface{}{jsonMap}, nil
+}
+
+func decodeCBOR(payload []byte) ([]map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+	if err := cborDecMode.Unmarshal(payload, &doc); err != nil {
+		return nil, err
+	}
+	return []map[string]interface{}{doc}, nil
+}
+
+func decodeMsgpack(payload []byte) ([]map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+	if err := msgpack.Unmarshal(payload, &doc); err != nil {
+		return nil, err
+	}
+	return []map[string]interface{}{doc}, nil
+}
+
+// decodeLineProtocol decodes InfluxDB line protocol. Every line is decoded into
+// a document with "measurement", "tags", "fields" and optional "timestamp" in nanoseconds.
+func decodeLineProtocol(payload []byte) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	dec := lineprotocol.NewDecoderWithBytes(payload)
+	for dec.Next() {
+		measurement, err := dec.Measurement()
+		if err != nil {
+			return nil, err
+		}
+		tags := make(map[string]interface{})
+		for {
+			k, v, err := dec.NextTag()
+			if err != nil {
+				return nil, err
+			}
+			if k == nil {
+				break
+			}
+			tags[string(k)] = string(v)
+		}
+		fields := make(map[string]interface{})
+		for {
+			k, v, err := dec.NextField()
+			if err != nil {
+				return nil, err
+			}
+			if k == nil {
+				break
+			}
+			fields[string(k)] = v.Interface()
+		}
+		doc := map[string]interface{}{
+			"measurement": string(measurement),
+			"tags":        tags,
+			"fields":      fields,
+		}
+		ts, err := dec.TimeBytes()
+		if err != nil {
+			return nil, err
+		}
+		if ts != nil {
+			ns, err := strconv.ParseInt(string(ts), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			doc["timestamp"] = ns
+		}
+		docs = append(docs, doc)
+	}
+	return docs, dec.Err()
+}
+
+// decodeLogfmt decodes logfmt records. Every record is decoded into a flat document of its keys.
+func decodeLogfmt(payload []byte) ([]map[string]interface{}, error) {
+	var docs []map[string]interface{}
+	dec := logfmt.NewDecoder(bytes.NewReader(payload))
+	for dec.ScanRecord() {
+		doc := make(map[string]interface{})
+		for dec.ScanKeyval() {
+			doc[string(dec.Key())] = string(dec.Value())
+		}
+		if len(doc) > 0 {
+			docs = append(docs, doc)
+		}
+	}
+	return docs, dec.Err()
+}
@@ -0,0 +1,140 @@
+package mqtt
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func Test_payloadDecoders(t *testing.T) {
+	doc := map[string]interface{}{
+		"city":         "Tokyo",
+		"temperatures": map[string]interface{}{"out": 12.5, "in": 22.15},
+		"size":         -5,
+	}
+	cborPayload, err := cbor.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgpackPayload, err := msgpack.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		decode  payloadDecoder
+		payload []byte
+	}{
+		{name: "JSON", decode: decodeJSON, payload: []byte(`{"city":"Tokyo", "temperatures": {"out": 12.5, "in": 22.15}, "size": -5}`)},
+		{name: "CBOR", decode: decodeCBOR, payload: cborPayload},
+		{name: "MessagePack", decode: decodeMsgpack, payload: msgpackPayload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := tt.decode(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) != 1 {
+				t.Fatalf("decode() returned %d documents, want 1", len(docs))
+			}
+			got := docs[0]
+			for path, want := range map[string]string{"city": "Tokyo", "temperatures.in": "22.15", "size": "-5"} {
+				v, ok := findInJSON(got, path)
+				if !ok || fmt.Sprintf("%v", v) != want {
+					t.Errorf("findInJSON(%s) = (%v, %v), want %v", path, v, ok, want)
+				}
+			}
+			if _, err := tt.decode([]byte{0xc1, 0x00}); err == nil {
+				t.Errorf("decode() of invalid payload expected error")
+			}
+		})
+	}
+}
+
+func Test_decodeLineProtocol(t *testing.T) {
+	docs, err := decodeLineProtocol([]byte("weather,location=us\\ west temperature=82,raw=5i,ok=true 1465839830100400200\n\nweather,location=eu humidity=0.4\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{
+		{
+			"measurement": "weather",
+			"tags":        map[string]interface{}{"location": "us west"},
+			"fields":      map[string]interface{}{"temperature": 82.0, "raw": int64(5), "ok": true},
+			"timestamp":   int64(1465839830100400200),
+		},
+		{
+			"measurement": "weather",
+			"tags":        map[string]interface{}{"location": "eu"},
+			"fields":      map[string]interface{}{"humidity": 0.4},
+		},
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("decodeLineProtocol() = %v, want %v", docs, want)
+	}
+
+	if _, err := decodeLineProtocol([]byte("weather temperature=")); err == nil {
+		t.Errorf("decodeLineProtocol() of invalid payload expected error")
+	}
+}
+
+func Test_decodeLogfmt(t *testing.T) {
+	docs, err := decodeLogfmt([]byte("room=kitchen temp=21.5 msg=\"all good\"\nroom=hall temp=19"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{
+		{"room": "kitchen", "temp": "21.5", "msg": "all good"},
+		{"room": "hall", "temp": "19"},
+	}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("decodeLogfmt() = %v, want %v", docs, want)
+	}
+
+	if _, err := decodeLogfmt([]byte(`room="kitchen`)); err == nil {
+		t.Errorf("decodeLogfmt() of invalid payload expected error")
+	}
+}
+
+func Test_payloadFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric config.Metric
+		want   string
+	}{
+		{name: "raw by default", metric: config.Metric{}, want: "raw"},
+		{name: "json inferred from field", metric: config.Metric{JSONField: "a"}, want: "json"},
+		{name: "protobuf inferred from descriptor", metric: config.Metric{JSONField: "a", ProtoDescSet: "a.pb"}, want: "protobuf"},
+		{name: "explicit format", metric: config.Metric{JSONField: "a", PayloadFormat: "CBOR"}, want: "cbor"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := payloadFormat(tt.metric); got != tt.want {
+				t.Errorf("payloadFormat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMessageHandler_InvalidPayloadFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric config.Metric
+	}{
+		{name: "unknown format", metric: config.Metric{PayloadFormat: "xml", JSONField: "a"}},
+		{name: "structured format without field", metric: config.Metric{PayloadFormat: "msgpack"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewMessageHandler(tt.metric, &fakeCollector{}); err == nil {
+				t.Errorf("NewMessageHandler() expected error")
+			}
+		})
+	}
+}
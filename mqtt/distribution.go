@@ -0,0 +1,130 @@
+package mqtt
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"github.com/torilabs/mqtt-prometheus-exporter/prometheus"
+)
+
+// validateDistribution checks buckets, objectives and labels of histogram or summary,
+// which would otherwise panic on the first observation.
+func validateDistribution(metric config.Metric) error {
+	switch metric.MetricType {
+	case "histogram":
+		for i := 1; i < len(metric.Buckets); i++ {
+			if metric.Buckets[i] <= metric.Buckets[i-1] {
+				return fmt.Errorf("histogram buckets must be in strictly increasing order")
+			}
+		}
+		if hasLabel(metric, "le") {
+			return fmt.Errorf("label 'le' is reserved by histogram")
+		}
+	case "summary":
+		for _, o := range metric.Objectives {
+			if o.Quantile <= 0 || o.Quantile >= 1 {
+				return fmt.Errorf("summary objective quantile '%v' must be between 0 and 1", o.Quantile)
+			}
+			if o.Error < 0 {
+				return fmt.Errorf("summary objective error '%v' must not be negative", o.Error)
+			}
+		}
+		if hasLabel(metric, "quantile") {
+			return fmt.Errorf("label 'quantile' is reserved by summary")
+		}
+	}
+	return nil
+}
+
+// parseDistribution converts pre-aggregated document like {"buckets":{"0.1":3,"+Inf":12},"sum":4.2,"count":12}
+// into histogram, or summary when quantiles are requested, e.g. {"quantiles":{"0.5":0.2},"sum":4.2,"count":12}.
+// Histogram count defaults to the +Inf bucket when not published.
+func parseDistribution(value interface{}, summary bool) (prometheus.Distribution, error) {
+	var d prometheus.Distribution
+	doc, ok := value.(map[string]interface{})
+	if !ok {
+		return d, fmt.Errorf("pre-aggregated value '%v' is not an object", value)
+	}
+	sum, found := doc["sum"]
+	if !found {
+		return d, fmt.Errorf("pre-aggregated value misses 'sum' field")
+	}
+	var err error
+	if d.Sum, err = toFloat(sum); err != nil {
+		return d, err
+	}
+	count, hasCount := doc["count"]
+	if hasCount {
+		if d.Count, err = toCount(count); err != nil {
+			return d, err
+		}
+	}
+
+	if summary {
+		quantiles, ok := doc["quantiles"].(map[string]interface{})
+		if !ok {
+			return d, fmt.Errorf("pre-aggregated summary misses 'quantiles' object")
+		}
+		if !hasCount {
+			return d, fmt.Errorf("pre-aggregated summary misses 'count' field")
+		}
+		d.Quantiles = make(map[float64]float64, len(quantiles))
+		for q, v := range quantiles {
+			quantile, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				return d, fmt.Errorf("invalid quantile '%s'", q)
+			}
+			if d.Quantiles[quantile], err = toFloat(v); err != nil {
+				return d, err
+			}
+		}
+		return d, nil
+	}
+
+	buckets, ok := doc["buckets"].(map[string]interface{})
+	if !ok {
+		return d, fmt.Errorf("pre-aggregated histogram misses 'buckets' object")
+	}
+	d.Buckets = make(map[float64]uint64, len(buckets))
+	infFound := false
+	for le, v := range buckets {
+		bound, err := strconv.ParseFloat(le, 64)
+		if err != nil {
+			return d, fmt.Errorf("invalid bucket bound '%s'", le)
+		}
+		c, err := toCount(v)
+		if err != nil {
+			return d, err
+		}
+		if math.IsInf(bound, 1) {
+			// +Inf bucket is implied by the count
+			infFound = true
+			if !hasCount {
+				d.Count = c
+			}
+			continue
+		}
+		d.Buckets[bound] = c
+	}
+	if !hasCount && !infFound {
+		return d, fmt.Errorf("pre-aggregated histogram misses 'count' field or '+Inf' bucket")
+	}
+	return d, nil
+}
+
+func toFloat(value interface{}) (float64, error) {
+	return strconv.ParseFloat(fmt.Sprintf("%v", value), 64)
+}
+
+func toCount(value interface{}) (uint64, error) {
+	f, err := toFloat(value)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 || f != math.Trunc(f) {
+		return 0, fmt.Errorf("invalid count '%v'", value)
+	}
+	return uint64(f), nil
+}
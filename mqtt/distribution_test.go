@@ -0,0 +1,122 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"github.com/torilabs/mqtt-prometheus-exporter/prometheus"
+)
+
+func Test_parseDistribution(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		summary bool
+		want    prometheus.Distribution
+		wantErr bool
+	}{
+		{
+			name:    "histogram",
+			payload: `{"buckets":{"0.1":3,"1":10,"+Inf":12},"sum":4.2,"count":12}`,
+			want:    prometheus.Distribution{Count: 12, Sum: 4.2, Buckets: map[float64]uint64{0.1: 3, 1: 10}},
+		},
+		{
+			name:    "histogram count from +Inf bucket",
+			payload: `{"buckets":{"0.5":1,"+Inf":2},"sum":1.5}`,
+			want:    prometheus.Distribution{Count: 2, Sum: 1.5, Buckets: map[float64]uint64{0.5: 1}},
+		},
+		{
+			name:    "summary",
+			payload: `{"quantiles":{"0.5":0.2,"0.99":0.9},"sum":4.2,"count":12}`,
+			summary: true,
+			want:    prometheus.Distribution{Count: 12, Sum: 4.2, Quantiles: map[float64]float64{0.5: 0.2, 0.99: 0.9}},
+		},
+		{name: "histogram without count", payload: `{"buckets":{"0.5":1},"sum":1.5}`, wantErr: true},
+		{name: "histogram without buckets", payload: `{"sum":1.5,"count":2}`, wantErr: true},
+		{name: "invalid bucket bound", payload: `{"buckets":{"le":1},"sum":1.5,"count":2}`, wantErr: true},
+		{name: "fractional count", payload: `{"buckets":{"1":1.5},"sum":1.5,"count":2}`, wantErr: true},
+		{name: "missing sum", payload: `{"buckets":{"1":1},"count":2}`, wantErr: true},
+		{name: "summary without count", payload: `{"quantiles":{"0.5":1},"sum":1.5}`, summary: true, wantErr: true},
+		{name: "not an object", payload: `12`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var value interface{}
+			if err := json.Unmarshal([]byte(tt.payload), &value); err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseDistribution(value, tt.summary)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDistribution() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDistribution() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_messageHandler_Preaggregated(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "gateway_latency_seconds",
+		MetricType:     "histogram",
+		Preaggregated:  true,
+		JSONLabels:     config.JSONLabels{"gateway": "id"},
+	}
+	collector := fakeCollector{}
+	mh, err := NewMessageHandler(metric, &collector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh(&fakeClient{}, &fakeMessage{topic: "/gw", payload: []byte(`{"id":"gw1","buckets":{"0.1":3,"+Inf":4},"sum":1.2,"count":4}`)})
+
+	want := prometheus.Distribution{Count: 4, Sum: 1.2, Buckets: map[float64]uint64{0.1: 3}}
+	if !reflect.DeepEqual(collector.obsDist, want) {
+		t.Errorf("distribution = %v, want %v", collector.obsDist, want)
+	}
+	if wantLabels := []string{"/gw", "gw1"}; !reflect.DeepEqual(collector.obsLabelValues, wantLabels) {
+		t.Errorf("label values = %v, want %v", collector.obsLabelValues, wantLabels)
+	}
+}
+
+func TestNewMessageHandler_InvalidPreaggregated(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric config.Metric
+	}{
+		{name: "gauge type", metric: config.Metric{MetricType: "gauge", Preaggregated: true}},
+		{name: "raw payload", metric: config.Metric{MetricType: "summary", Preaggregated: true, PayloadFormat: "raw"}},
+		{name: "wildcard field", metric: config.Metric{MetricType: "summary", Preaggregated: true, JSONField: "*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewMessageHandler(tt.metric, &fakeCollector{}); err == nil {
+				t.Errorf("NewMessageHandler() expected error")
+			}
+		})
+	}
+}
+
+func TestNewMessageHandler_InvalidDistribution(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric config.Metric
+	}{
+		{name: "unsorted buckets", metric: config.Metric{MetricType: "histogram", Buckets: []float64{1, 0.5}}},
+		{name: "duplicate buckets", metric: config.Metric{MetricType: "histogram", Buckets: []float64{0.5, 0.5}}},
+		{name: "le topic label", metric: config.Metric{MetricType: "histogram", TopicLabels: config.TopicLabels{"le": 1}}},
+		{name: "le json label", metric: config.Metric{MetricType: "histogram", JSONLabels: config.JSONLabels{"le": "le"}}},
+		{name: "quantile out of range", metric: config.Metric{MetricType: "summary", Objectives: []config.Objective{{Quantile: 1, Error: 0.01}}}},
+		{name: "zero quantile", metric: config.Metric{MetricType: "summary", Objectives: []config.Objective{{Quantile: 0, Error: 0.01}}}},
+		{name: "quantile const label", metric: config.Metric{MetricType: "summary", ConstantLabels: map[string]string{"quantile": "x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewMessageHandler(tt.metric, &fakeCollector{}); err == nil {
+				t.Errorf("NewMessageHandler() expected error")
+			}
+		})
+	}
+}
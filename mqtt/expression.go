@@ -0,0 +1,66 @@
+package mqtt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+)
+
+// expressionEnv is the set of variables visible to value and filter expressions.
+type expressionEnv struct {
+	Value    float64                `expr:"value"`
+	JSON     map[string]interface{} `expr:"json"`
+	Topic    string                 `expr:"topic"`
+	Segments []string               `expr:"segments"`
+	Labels   map[string]string      `expr:"labels"`
+}
+
+func newExpressionEnv(topic string, value float64, jsonMap map[string]interface{}, labels map[string]string) expressionEnv {
+	return expressionEnv{
+		Value:    value,
+		JSON:     jsonMap,
+		Topic:    topic,
+		Segments: strings.Split(topic, "/"),
+		Labels:   labels,
+	}
+}
+
+func compileValueExpr(src string) (*vm.Program, error) {
+	if src == "" {
+		return nil, nil
+	}
+	p, err := expr.Compile(src, expr.Env(expressionEnv{}), expr.AsFloat64())
+	if err != nil {
+		return nil, fmt.Errorf("invalid value expression '%s': %w", src, err)
+	}
+	return p, nil
+}
+
+func compileFilterExpr(src string) (*vm.Program, error) {
+	if src == "" {
+		return nil, nil
+	}
+	p, err := expr.Compile(src, expr.Env(expressionEnv{}), expr.AsBool())
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter expression '%s': %w", src, err)
+	}
+	return p, nil
+}
+
+func evalValueExpr(p *vm.Program, env expressionEnv) (float64, error) {
+	out, err := expr.Run(p, env)
+	if err != nil {
+		return 0, err
+	}
+	return out.(float64), nil
+}
+
+func evalFilterExpr(p *vm.Program, env expressionEnv) (bool, error) {
+	out, err := expr.Run(p, env)
+	if err != nil {
+		return false, err
+	}
+	return out.(bool), nil
+}
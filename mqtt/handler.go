@@ -1,77 +1,387 @@
 package mqtt
 
 import (
-	"encoding/json"
 	"fmt"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/expr-lang/expr/vm"
 	"github.com/torilabs/mqtt-prometheus-exporter/config"
 	"github.com/torilabs/mqtt-prometheus-exporter/log"
 	"github.com/torilabs/mqtt-prometheus-exporter/prometheus"
 	"go.uber.org/zap"
 )
 
+// maxBitPosition is the highest bit of status word exported by bit flags.
+const maxBitPosition = 52
+
 type messageHandler struct {
-	metric    config.Metric
-	collector prometheus.Collector
+	metric     config.Metric
+	collector  prometheus.Collector
+	format     string
+	decode     payloadDecoder
+	layout     *binaryLayout
+	valueExpr  *vm.Program
+	filterExpr *vm.Program
+	// topicLabels, jsonLabels and bitFlags are label keys in order of metric description
+	topicLabels []string
+	jsonLabels  []string
+	bitFlags    []string
 }
 
 // NewMessageHandler constructs handler for single metric.
-func NewMessageHandler(metric config.Metric, collector prometheus.Collector) pahomqtt.MessageHandler {
+func NewMessageHandler(metric config.Metric, collector prometheus.Collector) (pahomqtt.MessageHandler, error) {
+	valueExpr, err := compileValueExpr(metric.ValueExpr)
+	if err != nil {
+		return nil, fmt.Errorf("metric '%s': %w", metric.PrometheusName, err)
+	}
+	filterExpr, err := compileFilterExpr(metric.FilterExpr)
+	if err != nil {
+		return nil, fmt.Errorf("metric '%s': %w", metric.PrometheusName, err)
+	}
 	mh := &messageHandler{
-		metric:    metric,
-		collector: collector,
+		metric:      metric,
+		collector:   collector,
+		valueExpr:   valueExpr,
+		filterExpr:  filterExpr,
+		topicLabels: metric.TopicLabels.KeysInOrder(),
+		jsonLabels:  metric.JSONLabels.KeysInOrder(),
+		bitFlags:    metric.BitFlags.KeysInOrder(),
+	}
+	for flag, bit := range metric.BitFlags {
+		// values are carried as float64, which holds integers exactly up to 53 bits
+		if bit < 0 || bit > maxBitPosition {
+			return nil, fmt.Errorf("metric '%s': bit position '%d' of flag '%s' is out of range", metric.PrometheusName, bit, flag)
+		}
+	}
+	for _, a := range metric.Aggregations {
+		if metric.IsDistribution() {
+			return nil, fmt.Errorf("metric '%s': aggregations are not supported by type '%s'", metric.PrometheusName, metric.MetricType)
+		}
+		for _, fn := range a.Functions {
+			if !prometheus.IsAggregationFunction(fn) {
+				return nil, fmt.Errorf("metric '%s': unknown aggregation function '%s'", metric.PrometheusName, fn)
+			}
+		}
+	}
+	if len(metric.BitFlags) > 0 && hasConfiguredLabel(metric, "flag") {
+		return nil, fmt.Errorf("metric '%s': label 'flag' is reserved by bit_flags", metric.PrometheusName)
+	}
+	if metric.TrackStates && hasLabel(metric, "state") {
+		return nil, fmt.Errorf("metric '%s': label 'state' is reserved by track_states", metric.PrometheusName)
+	}
+	if err := validateDistribution(metric); err != nil {
+		return nil, fmt.Errorf("metric '%s': %w", metric.PrometheusName, err)
 	}
-	if metric.JSONField != "" {
-		return mh.getJSONMessageHandler()
+	if metric.TimestampPolicy() == "payload" && metric.TimestampField == "" {
+		return nil, fmt.Errorf("metric '%s': timestamp policy 'payload' requires timestamp_field", metric.PrometheusName)
+	}
+	mh.format = payloadFormat(metric)
+	if metric.Preaggregated {
+		if !metric.IsDistribution() {
+			return nil, fmt.Errorf("metric '%s': pre-aggregated metric must be of type 'histogram' or 'summary'", metric.PrometheusName)
+		}
+		if mh.format == "raw" || mh.format == "binary" || metric.HasWildcardField() || len(metric.BitFlags) > 0 {
+			return nil, fmt.Errorf("metric '%s': pre-aggregated metric requires single structured value", metric.PrometheusName)
+		}
+	}
+	switch mh.format {
+	case "raw":
+		return mh.getMessageHandler(), nil
+	case "binary":
+		if mh.layout, err = newBinaryLayout(metric.BinaryField); err != nil {
+			return nil, fmt.Errorf("metric '%s': %w", metric.PrometheusName, err)
+		}
+		if _, err := decodePayloadEncoding(metric.PayloadEnc, nil); err != nil {
+			return nil, fmt.Errorf("metric '%s': %w", metric.PrometheusName, err)
+		}
+		return mh.getBinaryMessageHandler(), nil
+	case "json":
+		mh.decode = decodeJSON
+	case "cbor":
+		mh.decode = decodeCBOR
+	case "msgpack":
+		mh.decode = decodeMsgpack
+	case "influx":
+		mh.decode = decodeLineProtocol
+	case "logfmt":
+		mh.decode = decodeLogfmt
+	case "protobuf":
+		md, err := loadMessageDescriptor(metric.ProtoDescSet, metric.ProtoMessage)
+		if err != nil {
+			return nil, fmt.Errorf("metric '%s': %w", metric.PrometheusName, err)
+		}
+		mh.decode = newProtobufDecoder(md)
+	default:
+		return nil, fmt.Errorf("metric '%s': unknown payload format '%s'", metric.PrometheusName, mh.format)
+	}
+	if metric.JSONField == "" && !metric.Preaggregated {
+		return nil, fmt.Errorf("metric '%s': payload format '%s' requires json_field", metric.PrometheusName, mh.format)
+	}
+	return mh.getStructuredMessageHandler(), nil
+}
+
+// hasConfiguredLabel checks if the metric has topic, json, unit or constant label of the name.
+func hasConfiguredLabel(metric config.Metric, name string) bool {
+	_, inTopic := metric.TopicLabels[name]
+	_, inJSON := metric.JSONLabels[name]
+	_, inConstant := metric.ConstantLabels[name]
+	return inTopic || inJSON || inConstant || metric.UnitLabel == name
+}
+
+// hasLabel checks if the metric has variable or constant label of the name.
+func hasLabel(metric config.Metric, name string) bool {
+	_, found := metric.ConstantLabels[name]
+	return found || slices.Contains(metric.VariableLabels(), name)
+}
+
+// payloadFormat resolves payload format of metric, inferring it from other fields when not set.
+func payloadFormat(metric config.Metric) string {
+	switch {
+	case metric.PayloadFormat != "":
+		return strings.ToLower(metric.PayloadFormat)
+	case metric.ProtoDescSet != "":
+		return "protobuf"
+	case metric.BinaryField != nil:
+		return "binary"
+	case metric.JSONField != "", metric.Preaggregated:
+		return "json"
+	default:
+		return "raw"
 	}
-	return mh.getMessageHandler()
 }
 
 func (h *messageHandler) getMessageHandler() pahomqtt.MessageHandler {
 	return func(_ pahomqtt.Client, msg pahomqtt.Message) {
 		strValue := string(msg.Payload())
 		log.Logger.Debugf("Received MQTT msg '%s' from '%s' topic. Listener for: '%s'.", strValue, msg.Topic(), h.metric.MqttTopic)
-		floatValue, err := strconv.ParseFloat(strValue, 64)
+		floatValue, unit, err := h.parseValue(strValue)
 		if err != nil {
 			log.Logger.With(zap.Error(err)).Warnf("Got data with unexpected value '%s' and failed to parse to float.", strValue)
 			return
 		}
-		labelCount := 1 + len(h.metric.TopicLabels)
-		labelValues := make([]string, 0, labelCount)
-		labelValues = append(labelValues, msg.Topic())
-		for _, tl := range h.metric.TopicLabels.KeysInOrder() {
-			labelValues = append(labelValues, getTopicPart(msg.Topic(), h.metric.TopicLabels[tl]))
+		h.observe(h.metric, msg.Topic(), floatValue, unit, time.Now(), nil)
+	}
+}
+
+func (h *messageHandler) getBinaryMessageHandler() pahomqtt.MessageHandler {
+	return func(_ pahomqtt.Client, msg pahomqtt.Message) {
+		log.Logger.Debugf("Received MQTT msg '%x' from '%s' topic. Listener for: '%s'.", msg.Payload(), msg.Topic(), h.metric.MqttTopic)
+
+		frame, err := decodePayloadEncoding(h.metric.PayloadEnc, msg.Payload())
+		if err != nil {
+			decodeFailures.WithLabelValues(h.metric.PrometheusName).Inc()
+			log.Logger.With(zap.Error(err)).Warnf("Got an invalid %s encoded frame '%s' and failed to decode.", h.metric.PayloadEnc, msg.Payload())
+			return
 		}
-		h.collector.Observe(h.metric, msg.Topic(), floatValue, labelValues...)
+		floatValue, err := h.layout.read(frame)
+		if err != nil {
+			decodeFailures.WithLabelValues(h.metric.PrometheusName).Inc()
+			log.Logger.With(zap.Error(err)).Warnf("Got an unexpected binary frame '%x' and failed to read value.", frame)
+			return
+		}
+		h.observe(h.metric, msg.Topic(), floatValue, "", time.Now(), nil)
 	}
 }
 
-func (h *messageHandler) getJSONMessageHandler() pahomqtt.MessageHandler {
+func (h *messageHandler) getStructuredMessageHandler() pahomqtt.MessageHandler {
 	return func(_ pahomqtt.Client, msg pahomqtt.Message) {
 		log.Logger.Debugf("Received MQTT msg '%s' from '%s' topic. Listener for: '%s'.", msg.Payload(), msg.Topic(), h.metric.MqttTopic)
 
-		jsonMap := make(map[string]interface{})
-		if err := json.Unmarshal(msg.Payload(), &jsonMap); err != nil {
-			log.Logger.With(zap.Error(err)).Warnf("Got an invalid JSON value '%s' and failed to unmarshal.", msg.Payload())
+		docs, err := h.decode(msg.Payload())
+		if err != nil {
+			decodeFailures.WithLabelValues(h.metric.PrometheusName).Inc()
+			log.Logger.With(zap.Error(err)).Warnf("Got an invalid %s value '%s' and failed to decode.", h.format, msg.Payload())
+			return
+		}
+
+		for _, doc := range docs {
+			ts, ok := h.timestamp(doc)
+			if !ok {
+				continue
+			}
+			if h.metric.HasWildcardField() {
+				h.observeWildcard(msg.Topic(), ts, doc)
+				continue
+			}
+			if h.metric.Preaggregated {
+				h.observeDistribution(msg.Topic(), ts, doc)
+				continue
+			}
+			if value, ok := findInJSON(doc, h.metric.JSONField); ok {
+				floatValue, unit, err := h.parseValue(value)
+				if err != nil {
+					log.Logger.With(zap.Error(err)).Warnf("Got data with unexpected value '%s' and failed to parse to float.", value)
+					continue
+				}
+				h.observe(h.metric, msg.Topic(), floatValue, unit, ts, doc)
+			}
+		}
+	}
+}
+
+// timestamp resolves sample time from the payload when timestamp_field is configured.
+// Samples with missing, invalid or future timestamp beyond tolerance are rejected.
+func (h *messageHandler) timestamp(doc map[string]interface{}) (time.Time, bool) {
+	now := time.Now()
+	if h.metric.TimestampField == "" || h.metric.TimestampPolicy() == "message" {
+		return now, true
+	}
+	value, found := findInJSON(doc, h.metric.TimestampField)
+	if !found {
+		log.Logger.Warnf("Timestamp field '%s' of metric '%s' not found in payload.", h.metric.TimestampField, h.metric.PrometheusName)
+		return now, false
+	}
+	ts, err := parseTimestamp(value, h.metric.TimestampFmt)
+	if err != nil {
+		log.Logger.With(zap.Error(err)).Warnf("Got unexpected timestamp '%v' of metric '%s'.", value, h.metric.PrometheusName)
+		return now, false
+	}
+	if ts.After(now.Add(h.metric.TimestampTol)) {
+		log.Logger.Warnf("Dropping sample of metric '%s' with timestamp '%v' in the future.", h.metric.PrometheusName, ts)
+		return now, false
+	}
+	messageLatency.WithLabelValues(h.metric.PrometheusName).Observe(now.Sub(ts).Seconds())
+	return ts, true
+}
+
+// parseValue converts decoded value to float, the stripped unit is returned when lenient parsing is enabled.
+func (h *messageHandler) parseValue(value interface{}) (float64, string, error) {
+	if floatValue, ok := value.(float64); ok && !h.metric.LenientParsing {
+		// decoded numbers need no formatting and parsing
+		return floatValue, "", nil
+	}
+	strValue := fmt.Sprintf("%v", value)
+	if h.metric.LenientParsing {
+		return parseLenientFloat(strValue)
+	}
+	floatValue, err := strconv.ParseFloat(strValue, 64)
+	return floatValue, "", err
+}
+
+// observeWildcard observes every numeric field under the wildcard path as metric named "<prom_name>_<field>".
+func (h *messageHandler) observeWildcard(topic string, ts time.Time, doc map[string]interface{}) {
+	fields := doc
+	if path := strings.TrimSuffix(strings.TrimSuffix(h.metric.JSONField, "*"), "."); path != "" {
+		value, ok := findInJSON(doc, path)
+		if !ok {
+			return
+		}
+		if fields, ok = value.(map[string]interface{}); !ok {
 			return
 		}
+	}
+	for field, value := range fields {
+		if _, ok := value.(map[string]interface{}); ok {
+			continue
+		}
+		floatValue, unit, err := h.parseValue(value)
+		if err != nil {
+			log.Logger.Debugf("Skipping non numeric field '%s' with value '%v'.", field, value)
+			continue
+		}
+		metric := h.metric
+		metric.PrometheusName = h.metric.PrometheusName + "_" + invalidNameChars.ReplaceAllString(field, "_")
+		h.observe(metric, topic, floatValue, unit, ts, doc)
+	}
+}
 
-		labelCount := 1 + len(h.metric.TopicLabels)
-		labelValues := make([]string, 0, labelCount)
-		labelValues = append(labelValues, msg.Topic())
-		for _, tl := range h.metric.TopicLabels.KeysInOrder() {
-			labelValues = append(labelValues, getTopicPart(msg.Topic(), h.metric.TopicLabels[tl]))
+// observeDistribution passes histogram or summary aggregated by the publisher to the collector.
+// The whole document is the distribution when json_field is not set.
+func (h *messageHandler) observeDistribution(topic string, ts time.Time, doc map[string]interface{}) {
+	var value interface{} = doc
+	if h.metric.JSONField != "" {
+		var ok bool
+		if value, ok = findInJSON(doc, h.metric.JSONField); !ok {
+			return
 		}
+	}
+	d, err := parseDistribution(value, h.metric.MetricType == "summary")
+	if err != nil {
+		log.Logger.With(zap.Error(err)).Warnf("Got unexpected pre-aggregated %s of metric '%s'.", h.metric.MetricType, h.metric.PrometheusName)
+		return
+	}
+	h.collector.ObserveDistribution(h.metric, topic, d, ts, h.labelValues(topic, "", doc)...)
+}
+
+// observe applies filter and value expressions and passes the value to the collector.
+func (h *messageHandler) observe(metric config.Metric, topic string, value float64, unit string, ts time.Time, doc map[string]interface{}) {
+	labelValues := h.labelValues(topic, unit, doc)
 
-		if value, ok := findInJSON(jsonMap, h.metric.JSONField); ok {
-			floatValue, err := strconv.ParseFloat(fmt.Sprintf("%v", value), 64)
+	if h.filterExpr != nil || h.valueExpr != nil {
+		env := newExpressionEnv(topic, value, doc, h.expressionLabels(labelValues))
+		if h.filterExpr != nil {
+			keep, err := evalFilterExpr(h.filterExpr, env)
+			if err != nil {
+				log.Logger.With(zap.Error(err)).Warnf("Evaluation of filter expression failed for metric '%s'.", h.metric.PrometheusName)
+				return
+			}
+			if !keep {
+				log.Logger.Debugf("Message from '%s' topic dropped by filter of metric '%s'.", topic, h.metric.PrometheusName)
+				return
+			}
+		}
+		if h.valueExpr != nil {
+			v, err := evalValueExpr(h.valueExpr, env)
 			if err != nil {
-				log.Logger.With(zap.Error(err)).Warnf("Got data with unexpected value '%s' and failed to parse to float.", value)
+				log.Logger.With(zap.Error(err)).Warnf("Evaluation of value expression failed for metric '%s'.", h.metric.PrometheusName)
 				return
 			}
-			h.collector.Observe(h.metric, msg.Topic(), floatValue, labelValues...)
+			value = v
+		}
+	}
+
+	if len(h.metric.BitFlags) > 0 {
+		word := int64(value)
+		for _, flag := range h.bitFlags {
+			bit := (word >> h.metric.BitFlags[flag]) & 1
+			flagLabelValues := append(labelValues[:len(labelValues):len(labelValues)], flag)
+			h.collector.Observe(metric, topic, float64(bit), ts, flagLabelValues...)
 		}
+		return
+	}
+
+	h.collector.Observe(metric, topic, value, ts, labelValues...)
+}
+
+// labelValues resolves values of variable labels in the order of metric description, without the bit flag.
+func (h *messageHandler) labelValues(topic, unit string, doc map[string]interface{}) []string {
+	labelCount := 2 + len(h.metric.TopicLabels) + len(h.metric.JSONLabels)
+	labelValues := make([]string, 0, labelCount)
+	labelValues = append(labelValues, topic)
+	for _, tl := range h.topicLabels {
+		labelValues = append(labelValues, getTopicPart(topic, h.metric.TopicLabels[tl]))
+	}
+	for _, jl := range h.jsonLabels {
+		labelValues = append(labelValues, getJSONLabel(doc, h.metric.JSONLabels[jl]))
+	}
+	if h.metric.UnitLabel != "" {
+		labelValues = append(labelValues, unit)
+	}
+	return labelValues
+}
+
+// expressionLabels maps label names to values the same way the exported series is labeled.
+func (h *messageHandler) expressionLabels(labelValues []string) map[string]string {
+	labels := make(map[string]string, len(h.metric.ConstantLabels)+len(labelValues))
+	for k, v := range h.metric.ConstantLabels {
+		labels[k] = v
+	}
+	labels["topic"] = labelValues[0]
+	i := 1
+	for _, tl := range h.topicLabels {
+		labels[tl] = labelValues[i]
+		i++
+	}
+	for _, jl := range h.jsonLabels {
+		labels[jl] = labelValues[i]
+		i++
+	}
+	if h.metric.UnitLabel != "" {
+		labels[h.metric.UnitLabel] = labelValues[i]
 	}
+	return labels
 }
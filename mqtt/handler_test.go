@@ -1,12 +1,18 @@
 package mqtt
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	expprom "github.com/torilabs/mqtt-prometheus-exporter/prometheus"
 )
 
 type fakeCollector struct {
@@ -14,15 +20,44 @@ type fakeCollector struct {
 	obsMetric      config.Metric
 	obsTopic       string
 	obsValue       float64
+	obsTimestamp   time.Time
 	obsLabelValues []string
+	obsAll         map[string]float64
+	obsDist        expprom.Distribution
+	obsAvailable   map[string]bool
 }
 
-func (c *fakeCollector) Observe(metric config.Metric, topic string, v float64, labelValues ...string) {
+func (c *fakeCollector) Observe(metric config.Metric, topic string, v float64, ts time.Time, labelValues ...string) {
 	c.observed = true
+	c.obsTimestamp = ts
 	c.obsMetric = metric
 	c.obsTopic = topic
 	c.obsValue = v
 	c.obsLabelValues = labelValues
+	if c.obsAll == nil {
+		c.obsAll = make(map[string]float64)
+	}
+	c.obsAll[metric.PrometheusName+"|"+strings.Join(labelValues, "|")] = v
+}
+
+func (c *fakeCollector) ObserveDistribution(metric config.Metric, topic string, d expprom.Distribution, ts time.Time, labelValues ...string) {
+	c.observed = true
+	c.obsTimestamp = ts
+	c.obsMetric = metric
+	c.obsTopic = topic
+	c.obsDist = d
+	c.obsLabelValues = labelValues
+}
+
+func (c *fakeCollector) ObserveAvailability(device string, online, _ bool) {
+	if c.obsAvailable == nil {
+		c.obsAvailable = make(map[string]bool)
+	}
+	c.obsAvailable[device] = online
+}
+
+func (c *fakeCollector) Close() error {
+	return nil
 }
 
 func (c *fakeCollector) Describe(chan<- *prometheus.Desc) {
@@ -165,12 +200,95 @@ func Test_messageHandler(t *testing.T) {
 			},
 			wantObserved: false,
 		},
+		{
+			name: "Raw value scaled by value expression",
+			args: args{
+				metric: config.Metric{
+					MqttTopic: "/topic/level2/level3/#",
+					ValueExpr: "value / 1000",
+				},
+			},
+			msg: fakeMessage{
+				topic:   "/topic/level2/level3/device",
+				payload: []byte("2500"),
+			},
+			wantObserved:    true,
+			wantValue:       2.5,
+			wantLabelValues: []string{"/topic/level2/level3/device"},
+		},
+		{
+			name: "JSON value converted using document and labels",
+			args: args{
+				metric: config.Metric{
+					MqttTopic:   "/topic/level2/level3/#",
+					TopicLabels: map[string]int{"device": -1},
+					JSONField:   "temperatures.out",
+					ValueExpr:   `labels.device == "device" && json.city == "Tokyo" ? (value - 32) * 5 / 9 : value`,
+				},
+			},
+			msg: fakeMessage{
+				topic:   "/topic/level2/level3/device",
+				payload: []byte(`{"city":"Tokyo", "temperatures": {"out": 50, "in": 22.15}, "size": -5}`),
+			},
+			wantObserved:    true,
+			wantValue:       10,
+			wantLabelValues: []string{"/topic/level2/level3/device", "device"},
+		},
+		{
+			name: "JSON message kept by filter expression",
+			args: args{
+				metric: config.Metric{
+					MqttTopic:  "/topic/level2/level3/#",
+					JSONField:  "size",
+					FilterExpr: `json.city == "Tokyo" && segments[2] == "level2"`,
+				},
+			},
+			msg: fakeMessage{
+				topic:   "/topic/level2/level3/device",
+				payload: []byte(`{"city":"Tokyo", "temperatures": {"out": 12.5, "in": 22.15}, "size": -5}`),
+			},
+			wantObserved:    true,
+			wantValue:       -5,
+			wantLabelValues: []string{"/topic/level2/level3/device"},
+		},
+		{
+			name: "JSON message dropped by filter expression",
+			args: args{
+				metric: config.Metric{
+					MqttTopic:  "/topic/level2/level3/#",
+					JSONField:  "size",
+					FilterExpr: "value > 0",
+				},
+			},
+			msg: fakeMessage{
+				topic:   "/topic/level2/level3/device",
+				payload: []byte(`{"city":"Tokyo", "temperatures": {"out": 12.5, "in": 22.15}, "size": -5}`),
+			},
+			wantObserved: false,
+		},
+		{
+			name: "Value expression failing at runtime drops the message",
+			args: args{
+				metric: config.Metric{
+					MqttTopic: "/topic/level2/level3/#",
+					ValueExpr: "value + json.offset",
+				},
+			},
+			msg: fakeMessage{
+				topic:   "/topic/level2/level3/device",
+				payload: []byte("12"),
+			},
+			wantObserved: false,
+		},
 	}
 	for _, tt := range tests {
 		for i := range 100 {
 			t.Run(fmt.Sprintf("%s-%d", tt.name, i+1), func(t *testing.T) {
 				collector := fakeCollector{}
-				mh := NewMessageHandler(tt.args.metric, &collector)
+				mh, err := NewMessageHandler(tt.args.metric, &collector)
+				if err != nil {
+					t.Fatal(err)
+				}
 				mh(&fakeClient{}, &tt.msg)
 
 				if tt.wantObserved != collector.observed {
@@ -196,3 +314,350 @@ func Test_messageHandler(t *testing.T) {
 		}
 	}
 }
+
+func TestNewMessageHandler_InvalidBitFlags(t *testing.T) {
+	for _, bit := range []int{-1, 53, 64} {
+		metric := config.Metric{BitFlags: map[string]int{"overflow": bit}}
+		if _, err := NewMessageHandler(metric, &fakeCollector{}); err == nil {
+			t.Errorf("NewMessageHandler() expected error for bit '%d'", bit)
+		}
+	}
+}
+
+func TestNewMessageHandler_InvalidAggregation(t *testing.T) {
+	metric := config.Metric{Aggregations: []config.Aggregation{{Window: time.Minute, Functions: []string{"median"}}}}
+	if _, err := NewMessageHandler(metric, &fakeCollector{}); err == nil {
+		t.Errorf("NewMessageHandler() expected error")
+	}
+}
+
+func TestNewMessageHandler_ReservedStateLabel(t *testing.T) {
+	metric := config.Metric{PrometheusName: "mode", JSONLabels: config.JSONLabels{"state": "state"}, TrackStates: true}
+	if _, err := NewMessageHandler(metric, &fakeCollector{}); err == nil {
+		t.Errorf("NewMessageHandler() expected error")
+	}
+}
+
+func TestNewMessageHandler_ReservedFlagLabel(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric config.Metric
+	}{
+		{
+			name:   "topic label",
+			metric: config.Metric{PrometheusName: "status", TopicLabels: config.TopicLabels{"flag": 2}, BitFlags: config.BitFlags{"fault": 0}},
+		},
+		{
+			name:   "json label",
+			metric: config.Metric{PrometheusName: "status", JSONLabels: config.JSONLabels{"flag": "kind"}, BitFlags: config.BitFlags{"fault": 0}},
+		},
+		{
+			name:   "constant label",
+			metric: config.Metric{PrometheusName: "status", ConstantLabels: map[string]string{"flag": "x"}, BitFlags: config.BitFlags{"fault": 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewMessageHandler(tt.metric, &fakeCollector{}); err == nil {
+				t.Errorf("NewMessageHandler() expected error for %v", tt.metric)
+			}
+		})
+	}
+}
+
+func TestNewMessageHandler_InvalidExpression(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric config.Metric
+	}{
+		{
+			name:   "syntax error in value expression",
+			metric: config.Metric{PrometheusName: "m", ValueExpr: "value *"},
+		},
+		{
+			name:   "value expression not returning number",
+			metric: config.Metric{PrometheusName: "m", ValueExpr: "topic"},
+		},
+		{
+			name:   "filter expression not returning bool",
+			metric: config.Metric{PrometheusName: "m", FilterExpr: "value + 1"},
+		},
+		{
+			name:   "unknown variable in filter expression",
+			metric: config.Metric{PrometheusName: "m", FilterExpr: "os.Exit(1)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewMessageHandler(tt.metric, &fakeCollector{}); err == nil {
+				t.Errorf("NewMessageHandler() expected error for %v", tt.metric)
+			}
+		})
+	}
+}
+
+func Test_messageHandler_MultipleValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  config.Metric
+		payload string
+		want    map[string]float64
+	}{
+		{
+			name: "line protocol with tags as labels",
+			metric: config.Metric{
+				PrometheusName: "cpu_idle",
+				PayloadFormat:  "influx",
+				JSONField:      "fields.usage_idle",
+				JSONLabels:     map[string]string{"host": "tags.host", "cpu": "tags.cpu"},
+			},
+			payload: "cpu,host=srv1,cpu=cpu0 usage_idle=98.5,usage_user=1i 1700000000000000000\ncpu,host=srv1,cpu=cpu1 usage_idle=97",
+			want: map[string]float64{
+				"cpu_idle|/telegraf|cpu0|srv1": 98.5,
+				"cpu_idle|/telegraf|cpu1|srv1": 97,
+			},
+		},
+		{
+			name: "line protocol wildcard fields",
+			metric: config.Metric{
+				PrometheusName: "mem",
+				PayloadFormat:  "influx",
+				JSONField:      "fields.*",
+				JSONLabels:     map[string]string{"host": "tags.host"},
+				FilterExpr:     `json.measurement == "mem"`,
+			},
+			payload: "mem,host=srv1 used=1024i,available_percent=42.5,status=\"ok\",active=true\ncpu,host=srv1 usage_idle=97",
+			want: map[string]float64{
+				"mem_used|/telegraf|srv1":              1024,
+				"mem_available_percent|/telegraf|srv1": 42.5,
+			},
+		},
+		{
+			name: "logfmt keys as labels and values",
+			metric: config.Metric{
+				PrometheusName: "sensor_temperature",
+				PayloadFormat:  "logfmt",
+				JSONField:      "temp",
+				JSONLabels:     map[string]string{"room": "room", "missing": "nothing"},
+			},
+			payload: "room=kitchen temp=21.5 msg=\"all good\"",
+			want: map[string]float64{
+				"sensor_temperature|/telegraf||kitchen": 21.5,
+			},
+		},
+		{
+			name: "logfmt wildcard",
+			metric: config.Metric{
+				PrometheusName: "sensor",
+				PayloadFormat:  "logfmt",
+				JSONField:      "*",
+			},
+			payload: "room=kitchen temp=21.5 humidity.rel=40",
+			want: map[string]float64{
+				"sensor_temp|/telegraf":         21.5,
+				"sensor_humidity_rel|/telegraf": 40,
+			},
+		},
+		{
+			name: "raw status word decoded into flags",
+			metric: config.Metric{
+				PrometheusName: "status_flag",
+				BitFlags:       map[string]int{"overheat": 0, "door_open": 2, "fault": 7},
+			},
+			payload: "5",
+			want: map[string]float64{
+				"status_flag|/telegraf|door_open": 1,
+				"status_flag|/telegraf|fault":     0,
+				"status_flag|/telegraf|overheat":  1,
+			},
+		},
+		{
+			name: "JSON status word decoded into flags",
+			metric: config.Metric{
+				PrometheusName: "status_flag",
+				JSONField:      "status",
+				JSONLabels:     map[string]string{"plc": "id"},
+				BitFlags:       map[string]int{"running": 1, "alarm": 15},
+			},
+			payload: `{"id": "plc1", "status": 32770}`,
+			want: map[string]float64{
+				"status_flag|/telegraf|plc1|alarm":   1,
+				"status_flag|/telegraf|plc1|running": 1,
+			},
+		},
+		{
+			name: "binary status word decoded into flags",
+			metric: config.Metric{
+				PrometheusName: "status_flag",
+				BinaryField:    &config.BinaryField{Offset: 1, Length: 2},
+				BitFlags:       map[string]int{"low": 0, "high": 8},
+			},
+			payload: "\x00\x01\x00",
+			want: map[string]float64{
+				"status_flag|/telegraf|high": 1,
+				"status_flag|/telegraf|low":  0,
+			},
+		},
+		{
+			name: "raw value with unit parsed leniently",
+			metric: config.Metric{
+				PrometheusName: "temperature",
+				LenientParsing: true,
+				UnitLabel:      "unit",
+			},
+			payload: "21,5 °C",
+			want: map[string]float64{
+				"temperature|/telegraf|°C": 21.5,
+			},
+		},
+		{
+			name: "JSON duration parsed leniently",
+			metric: config.Metric{
+				PrometheusName: "uptime_seconds",
+				JSONField:      "uptime",
+				LenientParsing: true,
+				ValueExpr:      "labels.unit == \"\" ? value : -1",
+				UnitLabel:      "unit",
+			},
+			payload: `{"uptime": "1h30m"}`,
+			want: map[string]float64{
+				"uptime_seconds|/telegraf|": 5400,
+			},
+		},
+		{
+			name: "JSON wildcard skips nested objects",
+			metric: config.Metric{
+				PrometheusName: "weather",
+				JSONField:      "*",
+			},
+			payload: `{"city":"Tokyo", "temperatures": {"out": 12.5, "in": 22.15}, "size": -5}`,
+			want: map[string]float64{
+				"weather_size|/telegraf": -5,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := fakeCollector{}
+			mh, err := NewMessageHandler(tt.metric, &collector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mh(&fakeClient{}, &fakeMessage{topic: "/telegraf", payload: []byte(tt.payload)})
+			if !reflect.DeepEqual(collector.obsAll, tt.want) {
+				t.Errorf("observed = %v, want %v", collector.obsAll, tt.want)
+			}
+		})
+	}
+}
+
+func Test_messageHandler_PayloadTimestamp(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "buffered_temperature",
+		JSONField:      "value",
+		TimestampField: "ts",
+		TimestampFmt:   "unix_ms",
+		TimestampTol:   time.Minute,
+	}
+	now := time.Now()
+	tests := []struct {
+		name         string
+		ts           interface{}
+		wantObserved bool
+		wantTs       time.Time
+	}{
+		{name: "past timestamp", ts: now.Add(-time.Hour).UnixMilli(), wantObserved: true, wantTs: time.UnixMilli(now.Add(-time.Hour).UnixMilli())},
+		{name: "future timestamp within tolerance", ts: now.Add(30 * time.Second).UnixMilli(), wantObserved: true, wantTs: time.UnixMilli(now.Add(30 * time.Second).UnixMilli())},
+		{name: "future timestamp beyond tolerance", ts: now.Add(time.Hour).UnixMilli()},
+		{name: "invalid timestamp", ts: "now"},
+		{name: "missing timestamp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc := map[string]interface{}{"value": 21.5}
+			if tt.ts != nil {
+				doc["ts"] = tt.ts
+			}
+			payload, err := json.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			collector := fakeCollector{}
+			mh, err := NewMessageHandler(metric, &collector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := testutil.CollectAndCount(messageLatency)
+			mh(&fakeClient{}, &fakeMessage{topic: "/buffered", payload: payload})
+			if collector.observed != tt.wantObserved {
+				t.Fatalf("observed = %v, want %v", collector.observed, tt.wantObserved)
+			}
+			if tt.wantObserved {
+				if !collector.obsTimestamp.Equal(tt.wantTs) {
+					t.Errorf("timestamp = %v, want %v", collector.obsTimestamp, tt.wantTs)
+				}
+				if testutil.CollectAndCount(messageLatency) < max(before, 1) {
+					t.Errorf("latency was not observed")
+				}
+			}
+		})
+	}
+}
+
+func Test_messageHandler_MessageTimestampPolicy(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		JSONField:      "value",
+		TimestampField: "ts",
+		TimestampMode:  "message",
+	}
+	collector := fakeCollector{}
+	mh, err := NewMessageHandler(metric, &collector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	mh(&fakeClient{}, &fakeMessage{topic: "/home", payload: []byte(`{"value": 21.5, "ts": 1000}`)})
+	if !collector.observed || collector.obsTimestamp.Before(before) {
+		t.Errorf("observed = %v, timestamp = %v, want receive time", collector.observed, collector.obsTimestamp)
+	}
+
+	metric.TimestampMode = "payload"
+	metric.TimestampField = ""
+	if _, err := NewMessageHandler(metric, &collector); err == nil {
+		t.Errorf("NewMessageHandler() expected error for payload policy without timestamp field")
+	}
+}
+
+func Benchmark_messageHandler(b *testing.B) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		MetricType:     "gauge",
+		MqttTopic:      "home/+/sensor",
+		JSONField:      "temperature",
+		TopicLabels:    config.TopicLabels{"room": 1},
+		JSONLabels:     config.JSONLabels{"unit": "unit"},
+	}
+	collector := expprom.NewCollector(time.Minute, []config.Metric{metric})
+	mh, err := NewMessageHandler(metric, collector)
+	if err != nil {
+		b.Fatal(err)
+	}
+	msgs := make([]fakeMessage, 1000)
+	for i := range msgs {
+		msgs[i] = fakeMessage{
+			topic:   fmt.Sprintf("home/room%d/sensor", i),
+			payload: []byte(`{"temperature": 21.5, "unit": "C"}`),
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var n atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mh(&fakeClient{}, &msgs[int(n.Add(1))%len(msgs)])
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+}
@@ -1,26 +1,45 @@
 package mqtt
 
-import "strings"
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
 
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// getTopicPart returns the topic segment at the index, negative index counts from the end.
+// The topic is scanned in place to avoid allocation per message.
 func getTopicPart(topic string, idx int) string {
-	s := strings.Split(topic, "/")
-	if idx > 0 && idx < len(s) {
-		return s[idx]
+	if idx < 0 {
+		idx += strings.Count(topic, "/") + 1
+		if idx < 0 {
+			return ""
+		}
+	} else if idx == 0 {
+		return ""
 	}
-	if idx < 0 && idx >= -len(s) {
-		return s[len(s)+idx]
+	for ; idx > 0; idx-- {
+		i := strings.IndexByte(topic, '/')
+		if i < 0 {
+			return ""
+		}
+		topic = topic[i+1:]
 	}
-	return ""
+	if i := strings.IndexByte(topic, '/'); i >= 0 {
+		return topic[:i]
+	}
+	return topic
 }
 
 func findInJSON(jsonMap map[string]interface{}, path string) (interface{}, bool) {
 	if path == "" || len(jsonMap) == 0 {
 		return nil, false
 	}
-	pp := strings.SplitN(path, ".", 2)
-	if val, found := jsonMap[pp[0]]; found && len(pp) > 1 {
+	key, rest, nested := strings.Cut(path, ".")
+	if val, found := jsonMap[key]; found && nested {
 		if subJSONMap, ok := val.(map[string]interface{}); ok {
-			return findInJSON(subJSONMap, pp[1])
+			return findInJSON(subJSONMap, rest)
 		}
 		return nil, false
 	} else if found {
@@ -28,3 +47,13 @@ func findInJSON(jsonMap map[string]interface{}, path string) (interface{}, bool)
 	}
 	return nil, false
 }
+
+func getJSONLabel(jsonMap map[string]interface{}, path string) string {
+	if val, found := findInJSON(jsonMap, path); found && val != nil {
+		if s, ok := val.(string); ok {
+			return s
+		}
+		return fmt.Sprintf("%v", val)
+	}
+	return ""
+}
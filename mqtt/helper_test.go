@@ -56,6 +56,22 @@ func Test_getTopicPart(t *testing.T) {
 			},
 			want: "",
 		},
+		{
+			name: "Last segment",
+			args: args{
+				topic: "level1/level2/level3",
+				idx:   -1,
+			},
+			want: "level3",
+		},
+		{
+			name: "First segment of topic without leading slash",
+			args: args{
+				topic: "level1/level2/level3",
+				idx:   -3,
+			},
+			want: "level1",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,20 @@
+package mqtt
+
+import (
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+var decodeFailures = prom.NewCounterVec(prom.CounterOpts{
+	Name: "mqtt_exporter_decode_failures_total",
+	Help: "Number of MQTT messages which failed to be decoded per metric.",
+}, []string{"metric"})
+
+var messageLatency = prom.NewHistogramVec(prom.HistogramOpts{
+	Name:    "mqtt_exporter_message_latency_seconds",
+	Help:    "Time between the payload timestamp and receiving the MQTT message per metric.",
+	Buckets: prom.ExponentialBuckets(0.01, 3, 10),
+}, []string{"metric"})
+
+func init() {
+	prom.MustRegister(decodeFailures, messageLatency)
+}
@@ -0,0 +1,96 @@
+package mqtt
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	numberWithSuffix = regexp.MustCompile(`^([+-]?(?:[0-9][0-9.,]*|[.,][0-9]+)(?:[eE][+-]?[0-9]+)?)(\s*)([\p{L}\p{No}°%/]*)$`)
+	isoDuration      = regexp.MustCompile(`^P(?:([0-9.,]+)Y)?(?:([0-9.,]+)M)?(?:([0-9.,]+)W)?(?:([0-9.,]+)D)?(?:T(?:([0-9.,]+)H)?(?:([0-9.,]+)M)?(?:([0-9.,]+)S)?)?$`)
+	// seconds of ISO-8601 duration designators, years and months are approximated
+	isoDurationUnits = []float64{365 * 86400, 30 * 86400, 7 * 86400, 86400, 3600, 60, 1}
+	// unitSymbols may start unit attached to number, letter units must be separated by whitespace
+	unitSymbols = "°%/µ"
+	// milli prefix is missing as "m" is parsed as minutes of Go duration
+	siPrefixes = map[string]float64{
+		"p": 1e-12, "n": 1e-9, "u": 1e-6, "µ": 1e-6,
+		"k": 1e3, "K": 1e3, "M": 1e6, "G": 1e9, "T": 1e12, "P": 1e15,
+	}
+)
+
+// parseLenientFloat parses human formatted numbers. It accepts decimal comma,
+// SI prefix attached to the number, unit suffix, Go and ISO-8601 durations (in seconds)
+// and RFC3339 timestamps (in unix seconds). Stripped unit is returned with the value.
+func parseLenientFloat(s string) (float64, string, error) {
+	s = strings.TrimSpace(s)
+	if v, err := strconv.ParseFloat(s, 64); err == nil {
+		return v, "", nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return float64(t.UnixNano()) / 1e9, "", nil
+	}
+	if v, ok := parseISODuration(s); ok {
+		return v, "", nil
+	}
+
+	// Go duration units take precedence, so "30m" is 30 minutes rather than 30 milli
+	if d, err := time.ParseDuration(s); err == nil {
+		return d.Seconds(), "", nil
+	}
+
+	match := numberWithSuffix.FindStringSubmatch(s)
+	if match == nil {
+		return 0, "", fmt.Errorf("value '%s' is not a number", s)
+	}
+	v, err := parseDecimal(match[1])
+	if err != nil {
+		return 0, "", err
+	}
+	attached, suffix := match[2] == "", match[3]
+	if multiplier, ok := siPrefixes[suffix]; ok && attached {
+		return v * multiplier, "", nil
+	}
+	if first, _ := utf8.DecodeRuneInString(suffix); attached && suffix != "" && !strings.ContainsRune(unitSymbols, first) {
+		// letters attached to number are other notation rather than unit, e.g. "0x1F"
+		return 0, "", fmt.Errorf("value '%s' has unexpected suffix '%s'", s, suffix)
+	}
+	return v, suffix, nil
+}
+
+// parseDecimal parses number with either dot or comma as decimal separator.
+// When both are present, the last one is the decimal separator and the other groups thousands.
+func parseDecimal(s string) (float64, error) {
+	dot, comma := strings.LastIndex(s, "."), strings.LastIndex(s, ",")
+	switch {
+	case comma > dot:
+		s = strings.ReplaceAll(s, ".", "")
+		s = strings.Replace(s, ",", ".", 1)
+	case comma >= 0:
+		s = strings.ReplaceAll(s, ",", "")
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseISODuration(s string) (float64, bool) {
+	match := isoDuration.FindStringSubmatch(s)
+	if match == nil || s == "P" || strings.HasSuffix(s, "T") {
+		return 0, false
+	}
+	seconds := 0.0
+	for i, part := range match[1:] {
+		if part == "" {
+			continue
+		}
+		v, err := parseDecimal(part)
+		if err != nil {
+			return 0, false
+		}
+		seconds += v * isoDurationUnits[i]
+	}
+	return seconds, true
+}
@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"math"
+	"testing"
+)
+
+func Test_parseLenientFloat(t *testing.T) {
+	tests := []struct {
+		value    string
+		want     float64
+		wantUnit string
+		wantErr  bool
+	}{
+		{value: "21.5", want: 21.5},
+		{value: " -3e2 ", want: -300},
+		{value: "21,5", want: 21.5},
+		{value: "1,234.5", want: 1234.5},
+		{value: "1.234,5", want: 1234.5},
+		{value: "21.5 °C", want: 21.5, wantUnit: "°C"},
+		{value: "21,5°C", want: 21.5, wantUnit: "°C"},
+		{value: "230 V", want: 230, wantUnit: "V"},
+		{value: "1.2k", want: 1200},
+		{value: "3M", want: 3e6},
+		{value: "15m", want: 900},
+		{value: "30m", want: 1800},
+		{value: "4.7µ", want: 4.7e-6},
+		{value: "5 m", want: 5, wantUnit: "m"},
+		{value: "1h30m", want: 5400},
+		{value: "250ms", want: 0.25},
+		{value: "1.5s", want: 1.5},
+		{value: "PT1H30M", want: 5400},
+		{value: "P1DT0.5S", want: 86400.5},
+		{value: "P2W", want: 1209600},
+		{value: "2023-11-14T22:13:20Z", want: 1700000000},
+		{value: "2023-11-14T23:13:20.5+01:00", want: 1700000000.5},
+		{value: "50%", want: 50, wantUnit: "%"},
+		{value: "3.3µV", want: 3.3, wantUnit: "µV"},
+		{value: "12 m/s²", want: 12, wantUnit: "m/s²"},
+		{value: "on", wantErr: true},
+		{value: "2023-11-14", wantErr: true},
+		{value: "12:30", wantErr: true},
+		{value: "0x1F", wantErr: true},
+		{value: "21abc", wantErr: true},
+		{value: "P", wantErr: true},
+		{value: "PT", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, unit, err := parseLenientFloat(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseLenientFloat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if math.Abs(got-tt.want) > 1e-9*math.Max(1, math.Abs(tt.want)) || unit != tt.wantUnit {
+				t.Errorf("parseLenientFloat() = (%v, %v), want (%v, %v)", got, unit, tt.want, tt.wantUnit)
+			}
+		})
+	}
+}
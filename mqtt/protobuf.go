@@ -0,0 +1,97 @@
+package mqtt
+
+import (
+	"fmt"
+	"os"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// loadMessageDescriptor finds message type in a serialized FileDescriptorSet file.
+func loadMessageDescriptor(path, messageType string) (protoreflect.MessageDescriptor, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read descriptor set: %w", err)
+	}
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(raw, fds); err != nil {
+		return nil, fmt.Errorf("failed to parse descriptor set '%s': %w", path, err)
+	}
+	files, err := protodesc.NewFiles(fds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve descriptor set '%s': %w", path, err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(messageType))
+	if err != nil {
+		return nil, fmt.Errorf("message type '%s' not found in '%s': %w", messageType, path, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("'%s' in '%s' is not a message type", messageType, path)
+	}
+	return md, nil
+}
+
+// newProtobufDecoder constructs decoder of protobuf payloads into generic tree.
+func newProtobufDecoder(md protoreflect.MessageDescriptor) payloadDecoder {
+	return func(payload []byte) ([]map[string]interface{}, error) {
+		msg := dynamicpb.NewMessage(md)
+		if err := proto.Unmarshal(payload, msg); err != nil {
+			return nil, err
+		}
+		return []map[string]interface{}{protoMessageToMap(msg)}, nil
+	}
+}
+
+// protoMessageToMap converts message into generic tree. Scalars without explicit presence are included
+// even when they hold the default value, as proto3 does not encode e.g. a reading of 0.
+func protoMessageToMap(msg protoreflect.Message) map[string]interface{} {
+	fields := msg.Descriptor().Fields()
+	m := make(map[string]interface{}, fields.Len())
+	for i := range fields.Len() {
+		fd := fields.Get(i)
+		if (fd.HasPresence() || fd.IsList() || fd.IsMap()) && !msg.Has(fd) {
+			continue
+		}
+		m[string(fd.Name())] = protoFieldValue(fd, msg.Get(fd))
+	}
+	return m
+}
+
+func protoFieldValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch {
+	case fd.IsList():
+		list := v.List()
+		values := make([]interface{}, list.Len())
+		for i := range values {
+			values[i] = protoSingularValue(fd, list.Get(i))
+		}
+		return values
+	case fd.IsMap():
+		values := make(map[string]interface{})
+		v.Map().Range(func(k protoreflect.MapKey, mv protoreflect.Value) bool {
+			values[k.String()] = protoSingularValue(fd.MapValue(), mv)
+			return true
+		})
+		return values
+	default:
+		return protoSingularValue(fd, v)
+	}
+}
+
+func protoSingularValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return protoMessageToMap(v.Message())
+	case protoreflect.EnumKind:
+		return int32(v.Enum())
+	case protoreflect.BytesKind:
+		return string(v.Bytes())
+	default:
+		return v.Interface()
+	}
+}
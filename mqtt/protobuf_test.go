@@ -0,0 +1,176 @@
+package mqtt
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func writeTestDescriptorSet(t *testing.T) string {
+	t.Helper()
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	fds := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String("telemetry.proto"),
+			Package: proto.String("test.telemetry"),
+			Syntax:  proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{
+				{
+					Name: proto.String("Climate"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						{Name: proto.String("temperature"), Number: proto.Int32(1), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_DOUBLE.Enum()},
+						{Name: proto.String("humidity"), Number: proto.Int32(2), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_FLOAT.Enum()},
+					},
+				},
+				{
+					Name: proto.String("Telemetry"),
+					Field: []*descriptorpb.FieldDescriptorProto{
+						{Name: proto.String("device"), Number: proto.Int32(1), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+						{Name: proto.String("uptime"), Number: proto.Int32(2), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_UINT64.Enum()},
+						{Name: proto.String("climate"), Number: proto.Int32(3), Label: optional, Type: descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(), TypeName: proto.String(".test.telemetry.Climate")},
+						{Name: proto.String("readings"), Number: proto.Int32(4), Label: repeated, Type: descriptorpb.FieldDescriptorProto_TYPE_SINT32.Enum()},
+					},
+				},
+			},
+		}},
+	}
+	raw, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "telemetry.pb")
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func encodeTestTelemetry(t *testing.T, md protoreflect.MessageDescriptor, temperature float64) []byte {
+	t.Helper()
+	msg := dynamicpb.NewMessage(md)
+	msg.Set(md.Fields().ByName("device"), protoreflect.ValueOfString("sensor1"))
+	msg.Set(md.Fields().ByName("uptime"), protoreflect.ValueOfUint64(3600))
+	climateFd := md.Fields().ByName("climate")
+	climate := dynamicpb.NewMessage(climateFd.Message())
+	climate.Set(climateFd.Message().Fields().ByName("temperature"), protoreflect.ValueOfFloat64(temperature))
+	msg.Set(climateFd, protoreflect.ValueOfMessage(climate))
+	readings := msg.Mutable(md.Fields().ByName("readings")).List()
+	readings.Append(protoreflect.ValueOfInt32(-3))
+	readings.Append(protoreflect.ValueOfInt32(4))
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func Test_protobufDecoder(t *testing.T) {
+	path := writeTestDescriptorSet(t)
+	md, err := loadMessageDescriptor(path, "test.telemetry.Telemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		temperature float64
+	}{
+		{name: "non-zero temperature", temperature: 21.5},
+		{name: "zero temperature", temperature: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			docs, err := newProtobufDecoder(md)(encodeTestTelemetry(t, md, tt.temperature))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := docs[0]
+			want := map[string]interface{}{
+				"device":   "sensor1",
+				"uptime":   uint64(3600),
+				"climate":  map[string]interface{}{"temperature": tt.temperature, "humidity": float32(0)},
+				"readings": []interface{}{int32(-3), int32(4)},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decode() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func Test_loadMessageDescriptor_Errors(t *testing.T) {
+	path := writeTestDescriptorSet(t)
+	invalid := filepath.Join(t.TempDir(), "invalid.pb")
+	if err := os.WriteFile(invalid, []byte{0xff}, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		messageType string
+	}{
+		{name: "missing file", path: filepath.Join(t.TempDir(), "missing.pb"), messageType: "test.telemetry.Telemetry"},
+		{name: "invalid file", path: invalid, messageType: "test.telemetry.Telemetry"},
+		{name: "unknown message", path: path, messageType: "test.telemetry.Unknown"},
+		{name: "not a message", path: path, messageType: "test.telemetry.Telemetry.device"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadMessageDescriptor(tt.path, tt.messageType); err == nil {
+				t.Errorf("loadMessageDescriptor() expected error")
+			}
+		})
+	}
+}
+
+func Test_protobufMessageHandler(t *testing.T) {
+	path := writeTestDescriptorSet(t)
+	md, err := loadMessageDescriptor(path, "test.telemetry.Telemetry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := config.Metric{
+		PrometheusName: "proto_temperature",
+		MqttTopic:      "/proto/+",
+		JSONField:      "climate.temperature",
+		ProtoDescSet:   path,
+		ProtoMessage:   "test.telemetry.Telemetry",
+		FilterExpr:     `json.device == "sensor1"`,
+	}
+
+	collector := fakeCollector{}
+	mh, err := NewMessageHandler(metric, &collector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mh(&fakeClient{}, &fakeMessage{topic: "/proto/sensor1", payload: encodeTestTelemetry(t, md, 21.5)})
+	if !collector.observed || collector.obsValue != 21.5 {
+		t.Errorf("observed = %v, value = %v, want 21.5", collector.observed, collector.obsValue)
+	}
+
+	collector = fakeCollector{}
+	mh(&fakeClient{}, &fakeMessage{topic: "/proto/sensor1", payload: encodeTestTelemetry(t, md, 0)})
+	if !collector.observed || collector.obsValue != 0 {
+		t.Errorf("observed = %v, value = %v, want 0", collector.observed, collector.obsValue)
+	}
+
+	collector = fakeCollector{}
+	before := testutil.ToFloat64(decodeFailures.WithLabelValues(metric.PrometheusName))
+	mh(&fakeClient{}, &fakeMessage{topic: "/proto/sensor1", payload: []byte{0xff, 0xff}})
+	if collector.observed {
+		t.Errorf("invalid payload observed")
+	}
+	if got := testutil.ToFloat64(decodeFailures.WithLabelValues(metric.PrometheusName)) - before; got != 1 {
+		t.Errorf("decode failures increased by %v, want 1", got)
+	}
+}
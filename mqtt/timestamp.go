@@ -0,0 +1,43 @@
+package mqtt
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTimestamp converts payload value into time. Supported formats are
+// "unix" (seconds), "unix_ms", "unix_ns", "rfc3339" or a custom Go time layout.
+func parseTimestamp(value interface{}, format string) (time.Time, error) {
+	s := strings.TrimSpace(fmt.Sprintf("%v", value))
+	switch strings.ToLower(format) {
+	case "", "unix":
+		return parseUnixTimestamp(s, 1e9)
+	case "unix_ms":
+		return parseUnixTimestamp(s, 1e6)
+	case "unix_ns":
+		return parseUnixTimestamp(s, 1)
+	case "rfc3339":
+		return time.Parse(time.RFC3339Nano, s)
+	default:
+		return time.Parse(format, s)
+	}
+}
+
+// parseUnixTimestamp parses number of units since unix epoch, where unit is given in nanoseconds.
+func parseUnixTimestamp(s string, unit float64) (time.Time, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil && (unit == 1 || math.Abs(float64(i)) < math.MaxInt64/unit) {
+		return time.Unix(0, i*int64(unit)), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid unix timestamp '%s': %w", s, err)
+	}
+	whole, frac := math.Modf(f)
+	if math.IsNaN(f) || math.Abs(whole*unit) >= math.MaxInt64 {
+		return time.Time{}, fmt.Errorf("unix timestamp '%s' is out of range", s)
+	}
+	return time.Unix(0, int64(whole)*int64(unit)+int64(math.Round(frac*unit))), nil
+}
@@ -0,0 +1,39 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_parseTimestamp(t *testing.T) {
+	want := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+	tests := []struct {
+		name    string
+		value   interface{}
+		format  string
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "unix seconds by default", value: 1700000000, want: want},
+		{name: "unix seconds from JSON number", value: 1.7e9, format: "unix", want: want},
+		{name: "fractional unix seconds", value: "1700000000.25", format: "unix", want: want.Add(250 * time.Millisecond)},
+		{name: "unix milliseconds", value: int64(1700000000123), format: "unix_ms", want: want.Add(123 * time.Millisecond)},
+		{name: "unix nanoseconds", value: "1700000000000000001", format: "unix_ns", want: want.Add(time.Nanosecond)},
+		{name: "RFC3339", value: "2023-11-14T23:13:20+01:00", format: "rfc3339", want: want},
+		{name: "custom layout", value: "14.11.2023 22:13:20", format: "02.01.2006 15:04:05", want: want},
+		{name: "invalid number", value: "yesterday", format: "unix", wantErr: true},
+		{name: "out of range", value: 1e300, format: "unix", wantErr: true},
+		{name: "invalid RFC3339", value: "2023-11-14", format: "rfc3339", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTimestamp(tt.value, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTimestamp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("parseTimestamp() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
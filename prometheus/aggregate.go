@@ -0,0 +1,102 @@
+package prometheus
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"github.com/torilabs/mqtt-prometheus-exporter/log"
+	"go.uber.org/zap"
+)
+
+// CollectorOption allows to configure collector.
+type CollectorOption func(c *memoryCachedCollector)
+
+// WithAggregates is option that adds metrics aggregated across live series of their source metrics.
+func WithAggregates(aggregates []config.Aggregate) CollectorOption {
+	return func(c *memoryCachedCollector) {
+		for _, a := range aggregates {
+			agg := &aggregate{Aggregate: a, desc: a.PrometheusDescription()}
+			c.aggregates[a.Source] = append(c.aggregates[a.Source], agg)
+			if c.descriptions != nil {
+				c.descriptions = append(c.descriptions, agg.desc)
+			}
+		}
+	}
+}
+
+type aggregate struct {
+	config.Aggregate
+	desc *prometheus.Desc
+}
+
+// aggregateGroup is a running aggregation of series sharing group_by label values.
+type aggregateGroup struct {
+	labelValues []string
+	sum         float64
+	min, max    float64
+	count       int
+}
+
+// selectLabels resolves values of the named labels of the series from its variable and constant labels.
+// Values are returned joined into a key too.
+func selectLabels(entry *collectorEntry, names []string) (string, []string) {
+	values := make([]string, len(names))
+	for i, name := range names {
+		values[i] = entry.constLabels[name]
+		for j, ln := range entry.labelNames {
+			if ln == name {
+				values[i] = entry.labelValues[j]
+				break
+			}
+		}
+	}
+	return seriesKey("", values), values
+}
+
+// aggregator accumulates live series into groups of every aggregate during single collection.
+type aggregator map[*aggregate]map[string]*aggregateGroup
+
+func (ag aggregator) add(a *aggregate, entry *collectorEntry) {
+	groups, found := ag[a]
+	if !found {
+		groups = make(map[string]*aggregateGroup)
+		ag[a] = groups
+	}
+	key, values := selectLabels(entry, a.GroupBy)
+	g, found := groups[key]
+	if !found {
+		g = &aggregateGroup{labelValues: values, min: math.Inf(1), max: math.Inf(-1)}
+		groups[key] = g
+	}
+	g.sum += entry.v
+	g.min = math.Min(g.min, entry.v)
+	g.max = math.Max(g.max, entry.v)
+	g.count++
+}
+
+func (ag aggregator) collect(mc chan<- prometheus.Metric) {
+	for a, groups := range ag {
+		for _, g := range groups {
+			var v float64
+			switch a.Function {
+			case "avg":
+				v = g.sum / float64(g.count)
+			case "min":
+				v = g.min
+			case "max":
+				v = g.max
+			case "count":
+				v = float64(g.count)
+			default:
+				v = g.sum
+			}
+			m, err := prometheus.NewConstMetric(a.desc, prometheus.GaugeValue, v, g.labelValues...)
+			if err != nil {
+				log.Logger.With(zap.Error(err)).Warnf("Creation of aggregate '%s' failed.", a.PrometheusName)
+				continue
+			}
+			mc <- m
+		}
+	}
+}
@@ -2,9 +2,13 @@ package prometheus
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
-	gocache "github.com/patrickmn/go-cache"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/torilabs/mqtt-prometheus-exporter/config"
 	"github.com/torilabs/mqtt-prometheus-exporter/log"
@@ -14,42 +18,434 @@ import (
 // Collector is an extended interface of prometheus.Collector.
 type Collector interface {
 	prometheus.Collector
-	Observe(metric config.Metric, topic string, v float64, labelValues ...string)
+	Observe(metric config.Metric, topic string, v float64, ts time.Time, labelValues ...string)
+	ObserveDistribution(metric config.Metric, topic string, d Distribution, ts time.Time, labelValues ...string)
+	ObserveAvailability(device string, online, removeSeries bool)
+	// Close releases resources of the collector and persists its state when configured.
+	Close() error
 }
 
 type memoryCachedCollector struct {
-	cache        *gocache.Cache
+	// mu guards distributions, derived metric state and availability
+	mu           sync.Mutex
+	store        *store
 	descriptions []*prometheus.Desc
+	// metrics are precomputed at startup, dynamic are created for names of wildcard fields
+	metrics   map[metricKey]*metricInfo
+	dynamicMu sync.RWMutex
+	dynamic   map[metricKey]*metricInfo
+	// distributions are histogram and summary vectors by metric name
+	distributions map[string]distributionVec
+	// aggregates are computed across series by source metric name
+	aggregates map[string][]*aggregate
+	// derived are metrics computed from their inputs by input metric name
+	derived map[string][]derivedInput
+	// deviceLabel identifies device of the series
+	deviceLabel string
+	devices     *deviceTracker
+	// available are devices by their reported availability
+	available     map[string]bool
+	availableDesc *prometheus.Desc
+	snapshot      config.Snapshot
+	done          chan struct{}
+	// scraping is the pass over series in progress, scraped is number of series of the last pass
+	scrapeMu sync.Mutex
+	scraping *scrape
+	scraped  int
 }
 
 type collectorEntry struct {
-	m  prometheus.Metric
-	ts time.Time
+	// m is histogram or summary, metrics of plain values are created from desc on collection
+	m           prometheus.Metric
+	desc        *prometheus.Desc
+	valueType   prometheus.ValueType
+	ts          time.Time
+	noTimestamp bool
+	v           float64
+	// name and labelValues identify the series, e.g. histogram or summary within its vector
+	name        string
+	labelValues []string
+	// labelNames and constLabels of series aggregated by aggregates
+	labelNames  []string
+	constLabels prometheus.Labels
+	// windows aggregate values over sliding windows
+	windows []*slidingWindow
+	state   *stateTracker
+	device  string
+	// exported is the metric sent to collections
+	once     sync.Once
+	exported prometheus.Metric
+}
+
+// scrape is single pass over stored series shared by concurrent collections.
+// Sliding windows and tracked states of the series are collected at the time of each collection.
+type scrape struct {
+	done    chan struct{}
+	metrics []prometheus.Metric
+	tracked []*collectorEntry
+	agg     aggregator
+}
+
+// collected returns metric of the series exported by collections, nil when it cannot be created.
+// It is created once as observations replace entries rather than modify them.
+func (e *collectorEntry) collected() prometheus.Metric {
+	e.once.Do(func() {
+		m := e.m
+		if m == nil {
+			var err error
+			if m, err = prometheus.NewConstMetric(e.desc, e.valueType, e.v, e.labelValues...); err != nil {
+				log.Logger.With(zap.Error(err)).Warnf("Creation of prometheus metric '%s' failed.", e.name)
+				return
+			}
+		}
+		if !e.noTimestamp {
+			// without timestamp prometheus applies staleness handling
+			m = prometheus.NewMetricWithTimestamp(e.ts, m)
+		}
+		e.exported = m
+	})
+	return e.exported
+}
+
+// metricKey identifies metric configuration, metrics of the same name may listen to different topics.
+type metricKey struct {
+	name  string
+	topic string
+}
+
+// metricInfo is computed once per metric, so observations do not rebuild descriptions and label names.
+type metricInfo struct {
+	desc       *prometheus.Desc
+	labelNames []string
+	// deviceIndex is index of device label among variable labels, -1 when the device is constant label
+	deviceIndex int
+	deviceConst string
+	aggregated  bool
+	derived     []derivedInput
 }
 
 // NewCollector constructs collector for incoming prometheus metrics.
-func NewCollector(expiration time.Duration, possibleMetrics []config.Metric) Collector {
+func NewCollector(expiration time.Duration, possibleMetrics []config.Metric, opts ...CollectorOption) Collector {
 	if len(possibleMetrics) == 0 {
 		log.Logger.Warn("No metrics are configured.")
 	}
 	var descs []*prometheus.Desc
 	for _, m := range possibleMetrics {
+		if m.HasWildcardField() {
+			// names of wildcard metrics are known only when messages arrive,
+			// describing no metric makes the collector unchecked
+			descs = nil
+			break
+		}
 		descs = append(descs, m.PrometheusDescription())
+		for _, a := range m.Aggregations {
+			for _, fn := range a.Functions {
+				descs = append(descs, aggregationDescription(m, fn, a.Window))
+			}
+		}
+		if m.TrackChanges {
+			descs = append(descs, stateChangeDescription(m))
+		}
+		if m.TrackStates {
+			descs = append(descs, stateSecondsDescription(m))
+		}
+	}
+	c := &memoryCachedCollector{
+		store:         newStore(expiration, cleanupInterval(expiration, possibleMetrics)),
+		descriptions:  descs,
+		metrics:       make(map[metricKey]*metricInfo, len(possibleMetrics)),
+		dynamic:       make(map[metricKey]*metricInfo),
+		distributions: make(map[string]distributionVec),
+		aggregates:    make(map[string][]*aggregate),
+		derived:       make(map[string][]derivedInput),
+		deviceLabel:   "topic",
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	for _, m := range possibleMetrics {
+		c.metrics[metricKey{name: m.PrometheusName, topic: m.MqttTopic}] = c.newMetricInfo(m)
 	}
-	return &memoryCachedCollector{
-		cache:        gocache.New(expiration, expiration*10),
-		descriptions: descs,
+	if c.available != nil {
+		c.availableDesc = c.availableDescription()
+		if c.descriptions != nil {
+			c.descriptions = append(c.descriptions, c.availableDesc)
+		}
 	}
+	c.store.onEvicted = c.evicted
+	c.startSnapshots(possibleMetrics)
+	return c
 }
 
-func (c *memoryCachedCollector) Observe(metric config.Metric, topic string, v float64, labelValues ...string) {
-	m, err := prometheus.NewConstMetric(metric.PrometheusDescription(), metric.PrometheusValueType(), v, labelValues...)
-	if err != nil {
+// cleanupInterval resolves how often expired series are removed from the smallest configured expiration,
+// zero when no series expire.
+func cleanupInterval(expiration time.Duration, metrics []config.Metric) time.Duration {
+	smallest := expiration
+	for _, m := range metrics {
+		if e := time.Duration(m.Expiration); e > 0 && (smallest <= 0 || e < smallest) {
+			smallest = e
+		}
+	}
+	if smallest <= 0 {
+		return 0
+	}
+	return smallest * 10
+}
+
+func (c *memoryCachedCollector) newMetricInfo(metric config.Metric) *metricInfo {
+	mi := &metricInfo{
+		desc:        metric.PrometheusDescription(),
+		labelNames:  metric.VariableLabels(),
+		deviceIndex: -1,
+		deviceConst: metric.ConstantLabels[c.deviceLabel],
+		derived:     c.derived[metric.PrometheusName],
+	}
+	_, mi.aggregated = c.aggregates[metric.PrometheusName]
+	for i, name := range mi.labelNames {
+		if name == c.deviceLabel {
+			mi.deviceIndex = i
+			break
+		}
+	}
+	return mi
+}
+
+// info returns precomputed information of the metric, it is created on first use for names of wildcard fields.
+func (c *memoryCachedCollector) info(metric config.Metric) *metricInfo {
+	key := metricKey{name: metric.PrometheusName, topic: metric.MqttTopic}
+	if mi, found := c.metrics[key]; found {
+		return mi
+	}
+	c.dynamicMu.RLock()
+	mi, found := c.dynamic[key]
+	c.dynamicMu.RUnlock()
+	if found {
+		return mi
+	}
+	mi = c.newMetricInfo(metric)
+	c.dynamicMu.Lock()
+	defer c.dynamicMu.Unlock()
+	if existing, found := c.dynamic[key]; found {
+		return existing
+	}
+	c.dynamic[key] = mi
+	return mi
+}
+
+// validate checks label values of the series, so invalid series are rejected on observation rather than on collection.
+func (mi *metricInfo) validate(labelValues []string) error {
+	if len(labelValues) != len(mi.labelNames) {
+		return fmt.Errorf("%d label values expected, got %d", len(mi.labelNames), len(labelValues))
+	}
+	for _, lv := range labelValues {
+		if !utf8.ValidString(lv) {
+			return fmt.Errorf("label value %q is not valid UTF-8", lv)
+		}
+	}
+	return nil
+}
+
+// device resolves the device of the series from its variable or constant labels.
+func (mi *metricInfo) device(labelValues []string) string {
+	if mi.deviceIndex >= 0 && mi.deviceIndex < len(labelValues) {
+		return labelValues[mi.deviceIndex]
+	}
+	return mi.deviceConst
+}
+
+// seriesKey joins metric name and label values into the key of the series.
+// Values are prefixed by their length, so values containing the separator do not collide.
+func seriesKey(name string, labelValues []string) string {
+	var buf [20]byte
+	n := len(name)
+	for _, lv := range labelValues {
+		n += len(lv) + len(strconv.AppendInt(buf[:0], int64(len(lv)), 10)) + 2
+	}
+	var b strings.Builder
+	b.Grow(n)
+	b.WriteString(name)
+	for _, lv := range labelValues {
+		b.WriteByte('|')
+		b.Write(strconv.AppendInt(buf[:0], int64(len(lv)), 10))
+		b.WriteByte(':')
+		b.WriteString(lv)
+	}
+	return b.String()
+}
+
+func (c *memoryCachedCollector) Observe(metric config.Metric, topic string, v float64, ts time.Time, labelValues ...string) {
+	mi := c.info(metric)
+	if err := mi.validate(labelValues); err != nil {
 		log.Logger.With(zap.Error(err)).Warnf("Creation of prometheus metric failed.")
 		return
 	}
-	key := fmt.Sprintf("%s|%s", metric.PrometheusName, topic)
-	c.cache.SetDefault(key, &collectorEntry{m: m, ts: time.Now()})
+	key := seriesKey(metric.PrometheusName, labelValues)
+	device := mi.device(labelValues)
+	now := time.Now()
+	if c.devices != nil {
+		c.devices.seen(device, now)
+	}
+
+	if metric.IsDistribution() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if existing, _, found := c.store.get(key); found && existing.ts.After(ts) {
+			log.Logger.Debugf("Dropping out of order sample of '%s' metric from '%s' topic.", metric.PrometheusName, topic)
+			return
+		}
+		c.observeDistribution(metric, key, device, v, ts, labelValues)
+		return
+	}
+
+	sh := c.store.shard(key)
+	sh.mu.Lock()
+	existing, found := sh.get(key, now.UnixNano())
+	if found && existing.entry.ts.After(ts) {
+		sh.mu.Unlock()
+		log.Logger.Debugf("Dropping out of order sample of '%s' metric from '%s' topic.", metric.PrometheusName, topic)
+		return
+	}
+
+	if metric.CounterMode != "" && (math.IsNaN(v) || math.IsInf(v, 0)) {
+		// single invalid value would break the counter for good
+		sh.mu.Unlock()
+		log.Logger.Warnf("Dropping non finite value '%v' of '%s' counter from '%s' topic.", v, metric.PrometheusName, topic)
+		return
+	}
+	switch metric.CounterMode {
+	case "cumulative":
+		v = sh.counter(key).accumulate(v)
+	case "delta":
+		if v < 0 {
+			sh.mu.Unlock()
+			log.Logger.Warnf("Dropping negative increment '%v' of '%s' counter from '%s' topic.", v, metric.PrometheusName, topic)
+			return
+		}
+		v = sh.counter(key).add(v)
+	}
+
+	entry := &collectorEntry{
+		desc:        mi.desc,
+		valueType:   metric.PrometheusValueType(),
+		ts:          ts,
+		noTimestamp: metric.TimestampPolicy() == "none",
+		device:      device,
+		v:           v,
+		name:        metric.PrometheusName,
+		labelValues: labelValues,
+	}
+	if mi.aggregated || len(mi.derived) > 0 {
+		entry.labelNames = mi.labelNames
+		entry.constLabels = metric.ConstantLabels
+	}
+	if len(metric.Aggregations) > 0 {
+		if found {
+			entry.windows = existing.entry.windows
+		} else {
+			entry.windows = newSlidingWindows(metric)
+		}
+		for _, w := range entry.windows {
+			w.observe(v, ts)
+		}
+	}
+	if metric.TrackChanges || metric.TrackStates {
+		st, found := sh.states[key]
+		if !found {
+			st = newStateTracker(metric)
+			sh.states[key] = st
+		}
+		st.observe(v, ts)
+		entry.state = st
+	}
+	sh.items[key] = storeItem{entry: entry, expires: c.store.expires(now, expiration(metric))}
+	sh.mu.Unlock()
+
+	if len(mi.derived) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, in := range mi.derived {
+		c.derive(in, key, entry)
+	}
+}
+
+func (c *memoryCachedCollector) ObserveDistribution(metric config.Metric, topic string, d Distribution, ts time.Time, labelValues ...string) {
+	mi := c.info(metric)
+	key := seriesKey(metric.PrometheusName, labelValues)
+	device := mi.device(labelValues)
+	if c.devices != nil {
+		c.devices.seen(device, time.Now())
+	}
+
+	var m prometheus.Metric
+	var err error
+	if metric.MetricType == "summary" {
+		m, err = prometheus.NewConstSummary(mi.desc, d.Count, d.Sum, d.Quantiles, labelValues...)
+	} else {
+		m, err = prometheus.NewConstHistogram(mi.desc, d.Count, d.Sum, d.Buckets, labelValues...)
+	}
+	if err != nil {
+		log.Logger.With(zap.Error(err)).Warnf("Creation of prometheus %s failed.", metric.MetricType)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, _, found := c.store.get(key); found && existing.ts.After(ts) {
+		log.Logger.Debugf("Dropping out of order sample of '%s' metric from '%s' topic.", metric.PrometheusName, topic)
+		return
+	}
+	c.store.set(key, &collectorEntry{m: m, ts: ts, noTimestamp: metric.TimestampPolicy() == "none", device: device}, expiration(metric))
+}
+
+func (c *memoryCachedCollector) observeDistribution(metric config.Metric, key, device string, v float64, ts time.Time, labelValues []string) {
+	vec, found := c.distributions[metric.PrometheusName]
+	if !found {
+		vec = newDistributionVec(metric)
+		c.distributions[metric.PrometheusName] = vec
+	}
+	o, err := vec.GetMetricWithLabelValues(labelValues...)
+	if err != nil {
+		log.Logger.With(zap.Error(err)).Warnf("Creation of prometheus %s failed.", metric.MetricType)
+		return
+	}
+	o.Observe(v)
+	c.store.set(key, &collectorEntry{
+		m:           o.(prometheus.Metric),
+		ts:          ts,
+		noTimestamp: metric.TimestampPolicy() == "none",
+		device:      device,
+		name:        metric.PrometheusName,
+		labelValues: labelValues,
+	}, expiration(metric))
+}
+
+// expiration resolves expiration of series of the metric, zero means the collector default.
+func expiration(metric config.Metric) time.Duration {
+	switch {
+	case metric.Expiration == config.NeverExpire:
+		return neverExpire
+	case metric.Expiration > 0:
+		return time.Duration(metric.Expiration)
+	default:
+		return 0
+	}
+}
+
+// evicted drops expired histogram or summary from its vector, so it starts over when observed again.
+func (c *memoryCachedCollector) evicted(key string, entry *collectorEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	vec, found := c.distributions[entry.name]
+	if !found {
+		return
+	}
+	if _, _, observed := c.store.get(key); observed {
+		// observed again after the expiration
+		return
+	}
+	vec.DeleteLabelValues(entry.labelValues...)
 }
 
 func (c *memoryCachedCollector) Describe(ch chan<- *prometheus.Desc) {
@@ -59,9 +455,63 @@ func (c *memoryCachedCollector) Describe(ch chan<- *prometheus.Desc) {
 }
 
 func (c *memoryCachedCollector) Collect(mc chan<- prometheus.Metric) {
-	log.Logger.Debugf("Collecting. Returned '%d' metrics.", c.cache.ItemCount())
-	for _, rawItem := range c.cache.Items() {
-		item := rawItem.Object.(*collectorEntry)
-		mc <- prometheus.NewMetricWithTimestamp(item.ts, item.m)
+	sc := c.scrapeSeries()
+	log.Logger.Debugf("Collecting. Returned '%d' metrics.", len(sc.metrics))
+	for _, m := range sc.metrics {
+		mc <- m
 	}
+	now := time.Now()
+	for _, item := range sc.tracked {
+		for _, w := range item.windows {
+			w.collect(mc, now, item.labelValues)
+		}
+		if item.state != nil {
+			item.state.collect(mc, now, item.labelValues)
+		}
+	}
+	sc.agg.collect(mc)
+	if c.devices != nil {
+		c.devices.collect(mc, now)
+	}
+	c.collectAvailability(mc)
+}
+
+// scrapeSeries passes stored series once for collections running concurrently,
+// they wait for the pass in progress and share its result.
+func (c *memoryCachedCollector) scrapeSeries() *scrape {
+	c.scrapeMu.Lock()
+	if sc := c.scraping; sc != nil {
+		c.scrapeMu.Unlock()
+		<-sc.done
+		return sc
+	}
+	sc := &scrape{
+		done:    make(chan struct{}),
+		metrics: make([]prometheus.Metric, 0, c.scraped),
+		agg:     make(aggregator),
+	}
+	c.scraping = sc
+	c.scrapeMu.Unlock()
+
+	c.store.each(func(_ string, si storeItem) {
+		item := si.entry
+		if item.labelNames != nil {
+			for _, a := range c.aggregates[item.name] {
+				sc.agg.add(a, item)
+			}
+		}
+		if item.windows != nil || item.state != nil {
+			sc.tracked = append(sc.tracked, item)
+		}
+		if m := item.collected(); m != nil {
+			sc.metrics = append(sc.metrics, m)
+		}
+	})
+
+	c.scrapeMu.Lock()
+	c.scraping = nil
+	c.scraped = len(sc.metrics)
+	c.scrapeMu.Unlock()
+	close(sc.done)
+	return sc
 }
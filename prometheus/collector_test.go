@@ -0,0 +1,570 @@
+package prometheus
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+type sample struct {
+	value float64
+	count uint64
+	ts    int64
+}
+
+func gather(t *testing.T, c prometheus.Collector) map[string]sample {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]sample)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			key := mf.GetName()
+			for _, lp := range m.GetLabel() {
+				key += "|" + lp.GetValue()
+			}
+			s := sample{ts: m.GetTimestampMs()}
+			switch {
+			case m.GetCounter() != nil:
+				s.value = m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				s.value = m.GetGauge().GetValue()
+			case m.GetHistogram() != nil:
+				s.value, s.count = m.GetHistogram().GetSampleSum(), m.GetHistogram().GetSampleCount()
+			case m.GetSummary() != nil:
+				s.value, s.count = m.GetSummary().GetSampleSum(), m.GetSummary().GetSampleCount()
+			default:
+				s.value = m.GetUntyped().GetValue()
+			}
+			got[key] = s
+		}
+	}
+	return got
+}
+
+func TestCollector_Observe(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		MetricType:     "gauge",
+		JSONLabels:     config.JSONLabels{"room": "room"},
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric})
+	ts := time.UnixMilli(1700000000000)
+
+	c.Observe(metric, "/home", 20, ts, "/home", "kitchen")
+	c.Observe(metric, "/home", 18, ts, "/home", "hall")
+	c.Observe(metric, "/home", 21, ts.Add(time.Second), "/home", "kitchen")
+	// out of order sample is dropped
+	c.Observe(metric, "/home", 19, ts.Add(-time.Second), "/home", "hall")
+
+	want := map[string]sample{
+		"temperature|kitchen|/home": {value: 21, ts: 1700000001000},
+		"temperature|hall|/home":    {value: 18, ts: 1700000000000},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_LabelValuesWithSeparator(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		MetricType:     "gauge",
+		JSONLabels:     config.JSONLabels{"room": "room"},
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric})
+	ts := time.UnixMilli(1700000000000)
+
+	c.Observe(metric, "x|y", 20, ts, "x|y", "z")
+	c.Observe(metric, "x", 18, ts, "x", "y|z")
+
+	want := map[string]sample{
+		"temperature|z|x|y": {value: 20, ts: 1700000000000},
+		"temperature|y|z|x": {value: 18, ts: 1700000000000},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_WildcardMetricsUnchecked(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "sensor",
+		JSONField:      "*",
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric})
+	ts := time.UnixMilli(1700000000000)
+
+	dynamic := metric
+	dynamic.PrometheusName = "sensor_temp"
+	c.Observe(dynamic, "/home", 20, ts, "/home")
+
+	want := map[string]sample{
+		"sensor_temp|/home": {value: 20, ts: 1700000000000},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_TimestampPolicyNone(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		MetricType:     "gauge",
+		TimestampMode:  "none",
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric})
+	c.Observe(metric, "/home", 20, time.UnixMilli(1700000000000), "/home")
+
+	want := map[string]sample{
+		"temperature|/home": {value: 20},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_CumulativeCounter(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "energy_total",
+		CounterMode:    "cumulative",
+	}
+	c := NewCollector(50*time.Millisecond, []config.Metric{metric})
+	ts := time.UnixMilli(1700000000000)
+
+	for i, raw := range []float64{100, 150, math.NaN(), 5, math.Inf(-1), 20} {
+		c.Observe(metric, "/meter", raw, ts.Add(time.Duration(i)*time.Second), "/meter")
+	}
+	want := map[string]sample{
+		"energy_total|/meter": {value: 170, ts: 1700000005000},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+
+	// accumulated state survives expiration of the series
+	time.Sleep(100 * time.Millisecond)
+	if got := gather(t, c); len(got) != 0 {
+		t.Fatalf("Collect() = %v, want expired series", got)
+	}
+	c.Observe(metric, "/meter", 2, ts.Add(10*time.Second), "/meter")
+	want = map[string]sample{
+		"energy_total|/meter": {value: 172, ts: 1700000010000},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_DeltaCounter(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "pulses_total",
+		CounterMode:    "delta",
+		JSONLabels:     config.JSONLabels{"device": "id"},
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric})
+	ts := time.UnixMilli(1700000000000)
+
+	for i, delta := range []float64{3, 1, -2, math.NaN(), math.Inf(1), 0, 1} {
+		c.Observe(metric, "/counter", delta, ts.Add(time.Duration(i)*time.Second), "/counter", "a")
+	}
+	c.Observe(metric, "/counter", 1, ts, "/counter", "b")
+
+	want := map[string]sample{
+		"pulses_total|a|/counter": {value: 5, ts: 1700000006000},
+		"pulses_total|b|/counter": {value: 1, ts: 1700000000000},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_Histogram(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "latency_seconds",
+		MetricType:     "histogram",
+		Buckets:        []float64{0.1, 0.5, 1},
+	}
+	c := NewCollector(50*time.Millisecond, []config.Metric{metric})
+	ts := time.UnixMilli(1700000000000)
+
+	for i, v := range []float64{0.05, 0.3, 0.7, 2} {
+		c.Observe(metric, "/api", v, ts.Add(time.Duration(i)*time.Second), "/api")
+	}
+	c.Observe(metric, "/db", 0.2, ts, "/db")
+
+	want := map[string]sample{
+		"latency_seconds|/api": {value: 3.05, count: 4, ts: 1700000003000},
+		"latency_seconds|/db":  {value: 0.2, count: 1, ts: 1700000000000},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+
+	// expired histogram starts over
+	time.Sleep(100 * time.Millisecond)
+	c.(*memoryCachedCollector).store.deleteExpired()
+	c.Observe(metric, "/api", 0.4, ts.Add(10*time.Second), "/api")
+	want = map[string]sample{
+		"latency_seconds|/api": {value: 0.4, count: 1, ts: 1700000010000},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_Summary(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "noise",
+		MetricType:     "summary",
+		Objectives:     []config.Objective{{Quantile: 0.5, Error: 0.05}},
+		JSONLabels:     config.JSONLabels{"sensor": "id"},
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric})
+	ts := time.UnixMilli(1700000000000)
+
+	for _, v := range []float64{1, 2, 3} {
+		c.Observe(metric, "/noise", v, ts, "/noise", "a")
+	}
+
+	want := map[string]sample{
+		"noise|a|/noise": {value: 6, count: 3, ts: 1700000000000},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_ObserveDistribution(t *testing.T) {
+	histogram := config.Metric{
+		PrometheusName: "gateway_latency_seconds",
+		MetricType:     "histogram",
+		Preaggregated:  true,
+	}
+	summary := config.Metric{
+		PrometheusName: "gateway_rtt_seconds",
+		MetricType:     "summary",
+		Preaggregated:  true,
+	}
+	c := NewCollector(time.Minute, []config.Metric{histogram, summary})
+	ts := time.UnixMilli(1700000000000)
+
+	c.ObserveDistribution(histogram, "/gw", Distribution{Count: 4, Sum: 1.2, Buckets: map[float64]uint64{0.1: 3}}, ts, "/gw")
+	// published distribution replaces the previous one
+	c.ObserveDistribution(histogram, "/gw", Distribution{Count: 6, Sum: 2.2, Buckets: map[float64]uint64{0.1: 4}}, ts.Add(time.Second), "/gw")
+	c.ObserveDistribution(summary, "/gw", Distribution{Count: 2, Sum: 0.4, Quantiles: map[float64]float64{0.5: 0.2}}, ts, "/gw")
+
+	want := map[string]sample{
+		"gateway_latency_seconds|/gw": {value: 2.2, count: 6, ts: 1700000001000},
+		"gateway_rtt_seconds|/gw":     {value: 0.4, count: 2, ts: 1700000000000},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_WindowedAggregations(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		MetricType:     "gauge",
+		TimestampMode:  "none",
+		Aggregations: []config.Aggregation{
+			{Window: time.Minute, Functions: []string{"min", "max", "avg", "last", "count"}},
+			{Window: time.Hour, Functions: []string{"max"}},
+		},
+	}
+	c := NewCollector(time.Hour, []config.Metric{metric})
+	now := time.Now()
+
+	// sample older than the 1m window counts only in the 1h window
+	c.Observe(metric, "/home", 30, now.Add(-10*time.Minute), "/home")
+	for i, v := range []float64{20, 24, 22} {
+		c.Observe(metric, "/home", v, now.Add(time.Duration(i-3)*time.Second), "/home")
+	}
+
+	want := map[string]sample{
+		"temperature|/home":          {value: 22},
+		"temperature_min_1m|/home":   {value: 20},
+		"temperature_max_1m|/home":   {value: 24},
+		"temperature_avg_1m|/home":   {value: 22},
+		"temperature_last_1m|/home":  {value: 22},
+		"temperature_count_1m|/home": {value: 3},
+		"temperature_max_1h|/home":   {value: 30},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_Aggregates(t *testing.T) {
+	power := config.Metric{
+		PrometheusName: "plug_power_watts",
+		MetricType:     "gauge",
+		TimestampMode:  "none",
+		TopicLabels:    config.TopicLabels{"plug": 2},
+		ConstantLabels: map[string]string{"site": "home"},
+	}
+	temperature := config.Metric{
+		PrometheusName: "temperature",
+		MetricType:     "gauge",
+		TimestampMode:  "none",
+		JSONLabels:     config.JSONLabels{"floor": "floor", "room": "room"},
+	}
+	c := NewCollector(time.Minute, []config.Metric{power, temperature}, WithAggregates([]config.Aggregate{
+		{PrometheusName: "power_watts", Source: "plug_power_watts", Function: "sum", GroupBy: []string{"site"}},
+		{PrometheusName: "plugs", Source: "plug_power_watts", Function: "count"},
+		{PrometheusName: "floor_temperature_avg", Source: "temperature", Function: "avg", GroupBy: []string{"floor"}},
+		{PrometheusName: "floor_temperature_max", Source: "temperature", Function: "max", GroupBy: []string{"floor"}},
+	}))
+	ts := time.Now()
+
+	c.Observe(power, "/plugs/a/power", 100, ts, "/plugs/a/power", "a")
+	c.Observe(power, "/plugs/b/power", 50, ts, "/plugs/b/power", "b")
+	c.Observe(temperature, "/home", 20, ts, "/home", "1", "kitchen")
+	c.Observe(temperature, "/home", 22, ts, "/home", "1", "hall")
+	c.Observe(temperature, "/home", 18, ts, "/home", "2", "bedroom")
+
+	got := gather(t, c)
+	want := map[string]sample{
+		"power_watts|home":        {value: 150},
+		"plugs":                   {value: 2},
+		"floor_temperature_avg|1": {value: 21},
+		"floor_temperature_avg|2": {value: 18},
+		"floor_temperature_max|1": {value: 22},
+		"floor_temperature_max|2": {value: 18},
+	}
+	for key, w := range want {
+		if got[key] != w {
+			t.Errorf("Collect()[%s] = %v, want %v", key, got[key], w)
+		}
+	}
+}
+
+func TestCollector_StateTracking(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "door_open",
+		MetricType:     "gauge",
+		TimestampMode:  "none",
+		TrackChanges:   true,
+		TrackStates:    true,
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric})
+	start := time.Now().Add(-time.Minute)
+
+	for _, s := range []struct {
+		offset time.Duration
+		value  float64
+	}{
+		{offset: 0, value: 0},
+		{offset: 10 * time.Second, value: 1},
+		{offset: 15 * time.Second, value: 1},
+		{offset: 30 * time.Second, value: 0},
+	} {
+		c.Observe(metric, "/door", s.value, start.Add(s.offset), "/door")
+	}
+
+	got := gather(t, c)
+	if want := float64(start.Add(30*time.Second).UnixNano()) / 1e9; math.Abs(got["door_open_last_change_timestamp_seconds|/door"].value-want) > 1e-3 {
+		t.Errorf("last change = %v, want %v", got["door_open_last_change_timestamp_seconds|/door"].value, want)
+	}
+	if open := got["door_open_state_seconds_total|1|/door"].value; open != 20 {
+		t.Errorf("open seconds = %v, want 20", open)
+	}
+	// closed for 10s before opening and for 30s since the last change until now
+	if closed := got["door_open_state_seconds_total|0|/door"].value; math.Abs(closed-40) > 1 {
+		t.Errorf("closed seconds = %v, want 40", closed)
+	}
+}
+
+func TestCollector_MetricExpirationWithoutDefault(t *testing.T) {
+	latency := config.Metric{
+		PrometheusName: "latency_seconds",
+		MetricType:     "histogram",
+		TimestampMode:  "none",
+		Expiration:     config.Expiration(10 * time.Millisecond),
+	}
+	c := NewCollector(0, []config.Metric{latency})
+	ts := time.UnixMilli(1700000000000)
+
+	c.Observe(latency, "/api", 0.2, ts, "/api")
+	time.Sleep(200 * time.Millisecond)
+	if n := c.(*memoryCachedCollector).store.len(); n != 0 {
+		t.Errorf("len() = %v, want expired series removed", n)
+	}
+
+	// removed histogram starts over
+	c.Observe(latency, "/api", 0.4, ts.Add(time.Second), "/api")
+	want := map[string]sample{
+		"latency_seconds|/api": {value: 0.4, count: 1},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCleanupInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiration time.Duration
+		metrics    []config.Metric
+		want       time.Duration
+	}{
+		{name: "default expiration", expiration: time.Minute, want: 10 * time.Minute},
+		{name: "no expiration", expiration: 0, metrics: []config.Metric{{Expiration: config.NeverExpire}}, want: 0},
+		{name: "metric expiration only", expiration: 0, metrics: []config.Metric{{Expiration: config.Expiration(time.Hour)}}, want: 10 * time.Hour},
+		{name: "smallest expiration", expiration: time.Minute, metrics: []config.Metric{{Expiration: config.Expiration(time.Second)}}, want: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cleanupInterval(tt.expiration, tt.metrics); got != tt.want {
+				t.Errorf("cleanupInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStateTracker_InvalidDescription(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "mode",
+		JSONLabels:     config.JSONLabels{"state": "state"},
+		TrackStates:    true,
+	}
+	st := newStateTracker(metric)
+	st.observe(1, time.Now())
+
+	mc := make(chan prometheus.Metric, 10)
+	st.collect(mc, time.Now(), []string{"/hvac", "heating"})
+	if len(mc) != 0 {
+		t.Errorf("collect() sent %v metrics, want 0", len(mc))
+	}
+}
+
+func TestCollector_MetricExpiration(t *testing.T) {
+	battery := config.Metric{PrometheusName: "battery", TimestampMode: "none", Expiration: config.NeverExpire}
+	power := config.Metric{PrometheusName: "power", TimestampMode: "none", Expiration: config.Expiration(20 * time.Millisecond)}
+	temperature := config.Metric{PrometheusName: "temperature", TimestampMode: "none"}
+	c := NewCollector(100*time.Millisecond, []config.Metric{battery, power, temperature})
+
+	for _, m := range []config.Metric{battery, power, temperature} {
+		c.Observe(m, "/device", 1, time.Now(), "/device")
+	}
+	time.Sleep(50 * time.Millisecond)
+	want := map[string]sample{
+		"battery|/device":     {value: 1},
+		"temperature|/device": {value: 1},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	want = map[string]sample{
+		"battery|/device": {value: 1},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestCollector_ConcurrentCollect(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		MetricType:     "gauge",
+		JSONLabels:     config.JSONLabels{"room": "room"},
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric})
+	ts := time.UnixMilli(1700000000000)
+	want := make(map[string]sample)
+	for i := range 100 {
+		room := fmt.Sprintf("room%d", i)
+		c.Observe(metric, "/home", float64(i), ts, "/home", room)
+		want["temperature|"+room+"|/home"] = sample{value: float64(i), ts: 1700000000000}
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := gather(t, c); !reflect.DeepEqual(got, want) {
+				t.Errorf("Collect() = %v, want %v", got, want)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// only the changed series is created again
+	c.Observe(metric, "/home", 50, ts.Add(time.Second), "/home", "room1")
+	want["temperature|room1|/home"] = sample{value: 50, ts: 1700000001000}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func BenchmarkCollector_Observe(b *testing.B) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		MetricType:     "gauge",
+		MqttTopic:      "home/+/temperature",
+		TopicLabels:    config.TopicLabels{"room": 1},
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric})
+	topics := make([]string, 1000)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("home/room%d/temperature", i)
+	}
+	rooms := make([]string, len(topics))
+	for i := range rooms {
+		rooms[i] = fmt.Sprintf("room%d", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	var n atomic.Int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := int(n.Add(1)) % len(topics)
+			c.Observe(metric, topics[i], 21.5, time.Now(), topics[i], rooms[i])
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+func BenchmarkCollector_Collect(b *testing.B) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		MetricType:     "gauge",
+		TopicLabels:    config.TopicLabels{"room": 1},
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric})
+	ts := time.Now()
+	for i := range 200000 {
+		topic := fmt.Sprintf("home/room%d/temperature", i)
+		c.Observe(metric, topic, 21.5, ts, topic, fmt.Sprintf("room%d", i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mc := make(chan prometheus.Metric, 1024)
+		go func() {
+			for range mc {
+			}
+		}()
+		for pb.Next() {
+			c.Collect(mc)
+		}
+		close(mc)
+	})
+}
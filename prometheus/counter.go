@@ -0,0 +1,23 @@
+package prometheus
+
+// counterState tracks device reported cumulative or delta counter of a single series.
+type counterState struct {
+	last   float64
+	offset float64
+}
+
+// accumulate returns monotonic value of cumulative counter, a raw value lower
+// than the previous one is treated as device counter reset.
+func (s *counterState) accumulate(raw float64) float64 {
+	if raw < s.last {
+		s.offset += s.last
+	}
+	s.last = raw
+	return s.offset + raw
+}
+
+// add increments counter by value reported as delta since the previous message.
+func (s *counterState) add(delta float64) float64 {
+	s.offset += delta
+	return s.offset
+}
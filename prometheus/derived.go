@@ -0,0 +1,206 @@
+package prometheus
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"github.com/torilabs/mqtt-prometheus-exporter/log"
+	"go.uber.org/zap"
+)
+
+// formulaFunctions are math functions available to formulas of derived metrics.
+var formulaFunctions = map[string]interface{}{
+	"log":   math.Log,
+	"log10": math.Log10,
+	"exp":   math.Exp,
+	"pow":   math.Pow,
+	"sqrt":  math.Sqrt,
+}
+
+// DerivedMetric is compiled derived metric configuration.
+type DerivedMetric struct {
+	config.Derived
+	desc    *prometheus.Desc
+	program *vm.Program
+	// joins are cache keys of input series by input variable, per join_on label values
+	joins map[string]map[string]string
+	// previous samples of source series by cache key for rate and derivative
+	previous map[string]rateSample
+}
+
+type rateSample struct {
+	v  float64
+	ts time.Time
+}
+
+// NewDerivedMetric compiles formula of the derived metric over its input variables.
+// Rate and derivative formula is optional and transforms the computed rate available as "value" variable.
+func NewDerivedMetric(d config.Derived) (*DerivedMetric, error) {
+	dm := &DerivedMetric{
+		Derived:  d,
+		desc:     d.PrometheusDescription(),
+		joins:    make(map[string]map[string]string),
+		previous: make(map[string]rateSample),
+	}
+	if d.IsRate() {
+		if d.Source == "" || len(d.Inputs) > 0 {
+			return nil, fmt.Errorf("derived metric '%s': function '%s' requires single source and no inputs", d.PrometheusName, d.Function)
+		}
+		dm.Inputs = map[string]string{"value": d.Source}
+		if d.Formula == "" {
+			return dm, nil
+		}
+	} else if len(d.Inputs) == 0 {
+		return nil, fmt.Errorf("derived metric '%s' has no inputs", d.PrometheusName)
+	}
+	var err error
+	if dm.program, err = expr.Compile(d.Formula, expr.Env(formulaEnv(dm.Inputs)), expr.AsFloat64()); err != nil {
+		return nil, fmt.Errorf("derived metric '%s': invalid formula '%s': %w", d.PrometheusName, d.Formula, err)
+	}
+	return dm, nil
+}
+
+func formulaEnv(inputs map[string]string) map[string]interface{} {
+	env := make(map[string]interface{}, len(formulaFunctions)+len(inputs))
+	for name, fn := range formulaFunctions {
+		env[name] = fn
+	}
+	for variable := range inputs {
+		env[variable] = 0.0
+	}
+	return env
+}
+
+// WithDerivedMetrics is option that adds metrics computed from their inputs whenever an input is observed.
+func WithDerivedMetrics(derived ...*DerivedMetric) CollectorOption {
+	return func(c *memoryCachedCollector) {
+		for _, d := range derived {
+			for variable, source := range d.Inputs {
+				c.derived[source] = append(c.derived[source], derivedInput{metric: d, variable: variable})
+			}
+			if c.descriptions != nil {
+				c.descriptions = append(c.descriptions, d.desc)
+			}
+		}
+	}
+}
+
+// derivedInput binds source metric to the variable of derived metric formula.
+type derivedInput struct {
+	metric   *DerivedMetric
+	variable string
+}
+
+// derive recomputes derived metric from the latest values of its inputs joined with the observed series.
+// Derived series expires together with the first of its inputs.
+func (c *memoryCachedCollector) derive(in derivedInput, key string, entry *collectorEntry) {
+	d := in.metric
+	if d.IsRate() {
+		c.deriveRate(d, key, entry)
+		return
+	}
+	joinKey, joinValues := selectLabels(entry, d.JoinOn)
+	joins, found := d.joins[joinKey]
+	if !found {
+		joins = make(map[string]string, len(d.Inputs))
+		d.joins[joinKey] = joins
+	}
+	joins[in.variable] = key
+	if len(joins) < len(d.Inputs) {
+		return
+	}
+
+	env := formulaEnv(nil)
+	ts := entry.ts
+	var expiration time.Time
+	for variable, inputKey := range joins {
+		input, exp, found := c.store.get(inputKey)
+		if !found {
+			return
+		}
+		env[variable] = input.v
+		if input.ts.After(ts) {
+			ts = input.ts
+		}
+		if !exp.IsZero() && (expiration.IsZero() || exp.Before(expiration)) {
+			expiration = exp
+		}
+	}
+	v, err := d.eval(env)
+	if err != nil {
+		log.Logger.With(zap.Error(err)).Warnf("Evaluation of formula of derived metric '%s' failed.", d.PrometheusName)
+		return
+	}
+	c.setDerived(d, joinValues, v, ts, expiration)
+}
+
+// deriveRate computes per-second change of the source series since its previous sample.
+// Samples within min_interval are skipped, rate treats a decrease as the counter reset.
+func (c *memoryCachedCollector) deriveRate(d *DerivedMetric, key string, entry *collectorEntry) {
+	prev, found := d.previous[key]
+	if !found {
+		d.previous[key] = rateSample{v: entry.v, ts: entry.ts}
+		return
+	}
+	interval := entry.ts.Sub(prev.ts)
+	if interval <= 0 || interval < d.MinInterval {
+		return
+	}
+	d.previous[key] = rateSample{v: entry.v, ts: entry.ts}
+
+	delta := entry.v - prev.v
+	if d.Function == "rate" && delta < 0 {
+		// counter restarted from zero
+		delta = entry.v
+	}
+	env := formulaEnv(nil)
+	env["value"] = delta / interval.Seconds()
+	v, err := d.eval(env)
+	if err != nil {
+		log.Logger.With(zap.Error(err)).Warnf("Evaluation of formula of derived metric '%s' failed.", d.PrometheusName)
+		return
+	}
+	_, expiration, _ := c.store.get(key)
+	_, joinValues := selectLabels(entry, d.JoinOn)
+	c.setDerived(d, joinValues, v, entry.ts, expiration)
+}
+
+// eval evaluates formula of the derived metric, the value of single variable is returned when there is no formula.
+func (d *DerivedMetric) eval(env map[string]interface{}) (float64, error) {
+	if d.program == nil {
+		return env["value"].(float64), nil
+	}
+	out, err := expr.Run(d.program, env)
+	if err != nil {
+		return 0, err
+	}
+	return out.(float64), nil
+}
+
+// setDerived stores derived series expiring at the given time.
+func (c *memoryCachedCollector) setDerived(d *DerivedMetric, joinValues []string, v float64, ts, expiration time.Time) {
+	m, err := prometheus.NewConstMetric(d.desc, prometheus.GaugeValue, v, joinValues...)
+	if err != nil {
+		log.Logger.With(zap.Error(err)).Warnf("Creation of derived metric '%s' failed.", d.PrometheusName)
+		return
+	}
+
+	ttl := neverExpire
+	if !expiration.IsZero() {
+		ttl = time.Until(expiration)
+	}
+	c.store.set(seriesKey(d.PrometheusName, joinValues), &collectorEntry{
+		m:           m,
+		ts:          ts,
+		v:           v,
+		name:        d.PrometheusName,
+		labelValues: joinValues,
+		labelNames:  d.JoinOn,
+		constLabels: d.ConstantLabels,
+	}, ttl)
+}
@@ -0,0 +1,133 @@
+package prometheus
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+func TestNewDerivedMetric_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		derived config.Derived
+	}{
+		{name: "no inputs", derived: config.Derived{PrometheusName: "power", Formula: "1"}},
+		{name: "unknown variable", derived: config.Derived{PrometheusName: "power", Inputs: map[string]string{"u": "voltage"}, Formula: "u * i"}},
+		{name: "rate without source", derived: config.Derived{PrometheusName: "power", Function: "rate"}},
+		{name: "rate with inputs", derived: config.Derived{PrometheusName: "power", Function: "rate", Source: "energy", Inputs: map[string]string{"e": "energy"}}},
+		{name: "rate formula with unknown variable", derived: config.Derived{PrometheusName: "power", Function: "rate", Source: "energy", Formula: "rate * 3600"}},
+		{name: "non numeric formula", derived: config.Derived{PrometheusName: "power", Inputs: map[string]string{"u": "voltage"}, Formula: "u > 1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewDerivedMetric(tt.derived); err == nil {
+				t.Errorf("NewDerivedMetric() expected error")
+			}
+		})
+	}
+}
+
+func TestCollector_DerivedMetrics(t *testing.T) {
+	temperature := config.Metric{PrometheusName: "temperature", TopicLabels: config.TopicLabels{"room": 2}}
+	humidity := config.Metric{PrometheusName: "humidity", TopicLabels: config.TopicLabels{"room": 2}}
+	dewPoint, err := NewDerivedMetric(config.Derived{
+		PrometheusName: "dew_point",
+		Inputs:         map[string]string{"t": "temperature", "rh": "humidity"},
+		Formula:        "243.04 * (log(rh/100) + 17.625*t/(243.04+t)) / (17.625 - log(rh/100) - 17.625*t/(243.04+t))",
+		JoinOn:         []string{"room"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCollector(50*time.Millisecond, []config.Metric{temperature, humidity}, WithDerivedMetrics(dewPoint))
+	ts := time.UnixMilli(1700000000000)
+
+	c.Observe(temperature, "/home/kitchen/temperature", 20, ts, "/home/kitchen/temperature", "kitchen")
+	c.Observe(temperature, "/home/hall/temperature", 25, ts, "/home/hall/temperature", "hall")
+	// hall has no humidity, only kitchen is derived
+	c.Observe(humidity, "/home/kitchen/humidity", 50, ts.Add(time.Second), "/home/kitchen/humidity", "kitchen")
+
+	got := gather(t, c)
+	if len(got) != 4 {
+		t.Errorf("Collect() = %v, want 4 series", got)
+	}
+	s := got["dew_point|kitchen"]
+	if math.Abs(s.value-9.26) > 0.01 || s.ts != 1700000001000 {
+		t.Errorf("dew point = %v, want 9.26 at 1700000001000", s)
+	}
+
+	// recomputed when an input updates
+	c.Observe(temperature, "/home/kitchen/temperature", 25, ts.Add(2*time.Second), "/home/kitchen/temperature", "kitchen")
+	if s := gather(t, c)["dew_point|kitchen"]; math.Abs(s.value-13.85) > 0.01 {
+		t.Errorf("dew point = %v, want 13.85", s.value)
+	}
+
+	// stale when an input expires
+	time.Sleep(30 * time.Millisecond)
+	c.Observe(temperature, "/home/kitchen/temperature", 25, ts.Add(3*time.Second), "/home/kitchen/temperature", "kitchen")
+	time.Sleep(30 * time.Millisecond)
+	if _, found := gather(t, c)["dew_point|kitchen"]; found {
+		t.Errorf("dew point was not expired with humidity")
+	}
+}
+
+func TestCollector_DerivedRate(t *testing.T) {
+	energy := config.Metric{PrometheusName: "energy_wh_total", TopicLabels: config.TopicLabels{"meter": 2}}
+	temperature := config.Metric{PrometheusName: "temperature"}
+	power, err := NewDerivedMetric(config.Derived{
+		PrometheusName: "power_watts",
+		Function:       "rate",
+		Source:         "energy_wh_total",
+		MinInterval:    10 * time.Second,
+		Formula:        "value * 3600",
+		JoinOn:         []string{"meter"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	heating, err := NewDerivedMetric(config.Derived{
+		PrometheusName: "temperature_change",
+		Function:       "deriv",
+		Source:         "temperature",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCollector(time.Minute, []config.Metric{energy, temperature}, WithDerivedMetrics(power, heating))
+	ts := time.UnixMilli(1700000000000)
+
+	tests := []struct {
+		name      string
+		offset    time.Duration
+		energy    float64
+		wantPower float64
+	}{
+		{name: "first sample", offset: 0, energy: 1000},
+		{name: "within min interval", offset: 5 * time.Second, energy: 1001, wantPower: 0},
+		{name: "rate since the first sample", offset: 20 * time.Second, energy: 1010, wantPower: 1800},
+		{name: "counter reset", offset: 56 * time.Second, energy: 3, wantPower: 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.Observe(energy, "/meters/m1/energy", tt.energy, ts.Add(tt.offset), "/meters/m1/energy", "m1")
+			got, found := gather(t, c)["power_watts|m1"]
+			if tt.wantPower == 0 {
+				if found {
+					t.Errorf("power = %v, want no sample", got)
+				}
+				return
+			}
+			if math.Abs(got.value-tt.wantPower) > 1e-9 {
+				t.Errorf("power = %v, want %v", got.value, tt.wantPower)
+			}
+		})
+	}
+
+	c.Observe(temperature, "/room", 22, ts, "/room")
+	c.Observe(temperature, "/room", 20, ts.Add(4*time.Second), "/room")
+	if got := gather(t, c)["temperature_change"]; got.value != -0.5 {
+		t.Errorf("derivative = %v, want -0.5", got.value)
+	}
+}
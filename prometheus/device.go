@@ -0,0 +1,132 @@
+package prometheus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"github.com/torilabs/mqtt-prometheus-exporter/log"
+)
+
+// WithDevices is option that sets the label of observed series identifying devices
+// and tracks liveness of devices when enabled.
+func WithDevices(cfg config.Devices) CollectorOption {
+	return func(c *memoryCachedCollector) {
+		if cfg.Label != "" {
+			c.deviceLabel = cfg.Label
+		}
+		if !cfg.Enabled {
+			return
+		}
+		c.devices = newDeviceTracker(cfg)
+		if c.descriptions != nil {
+			c.descriptions = append(c.descriptions, c.devices.lastSeenDesc, c.devices.upDesc)
+		}
+	}
+}
+
+type deviceTracker struct {
+	mu        sync.Mutex
+	timeout   time.Duration
+	retention time.Duration
+	lastSeen  map[string]time.Time
+	expected  map[string]bool
+
+	lastSeenDesc *prometheus.Desc
+	upDesc       *prometheus.Desc
+}
+
+func newDeviceTracker(cfg config.Devices) *deviceTracker {
+	dt := &deviceTracker{
+		timeout:      cfg.Timeout,
+		retention:    cfg.Retention,
+		lastSeen:     make(map[string]time.Time, len(cfg.Expected)),
+		expected:     make(map[string]bool, len(cfg.Expected)),
+		lastSeenDesc: prometheus.NewDesc("device_last_seen_timestamp_seconds", "Time the device was seen the last time.", []string{cfg.Label}, nil),
+		upDesc:       prometheus.NewDesc("device_up", "Whether the device was seen within the timeout.", []string{cfg.Label}, nil),
+	}
+	for _, device := range cfg.Expected {
+		// expected devices are reported down until they are seen
+		dt.lastSeen[device] = time.Time{}
+		dt.expected[device] = true
+	}
+	return dt
+}
+
+func (dt *deviceTracker) seen(device string, now time.Time) {
+	if device == "" {
+		return
+	}
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.lastSeen[device] = now
+}
+
+func (dt *deviceTracker) collect(mc chan<- prometheus.Metric, now time.Time) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	for device, lastSeen := range dt.lastSeen {
+		// devices not expected are forgotten after the retention, so the map does not grow with every device ever seen
+		if !dt.expected[device] && dt.retention > 0 && now.Sub(lastSeen) > dt.retention {
+			delete(dt.lastSeen, device)
+			continue
+		}
+		up := 0.0
+		if !lastSeen.IsZero() {
+			collectConst(mc, dt.lastSeenDesc, prometheus.GaugeValue, float64(lastSeen.UnixNano())/1e9, device)
+			if now.Sub(lastSeen) <= dt.timeout {
+				up = 1
+			}
+		}
+		collectConst(mc, dt.upDesc, prometheus.GaugeValue, up, device)
+	}
+}
+
+// WithAvailability is option that exports availability of devices published to availability topics.
+func WithAvailability() CollectorOption {
+	return func(c *memoryCachedCollector) {
+		c.available = make(map[string]bool)
+	}
+}
+
+func (c *memoryCachedCollector) availableDescription() *prometheus.Desc {
+	return prometheus.NewDesc("device_available", "Whether the device reported it is online.", []string{c.deviceLabel}, nil)
+}
+
+func (c *memoryCachedCollector) ObserveAvailability(device string, online, removeSeries bool) {
+	c.mu.Lock()
+	if c.available == nil {
+		c.mu.Unlock()
+		return
+	}
+	c.available[device] = online
+	c.mu.Unlock()
+	if online || !removeSeries {
+		return
+	}
+
+	// deleted outside of the lock as eviction of histograms and summaries locks the collector
+	var keys []string
+	c.store.each(func(key string, item storeItem) {
+		if item.entry.device == device {
+			keys = append(keys, key)
+		}
+	})
+	for _, key := range keys {
+		c.store.delete(key)
+	}
+	log.Logger.Debugf("Device '%s' is offline, removed '%d' series.", device, len(keys))
+}
+
+func (c *memoryCachedCollector) collectAvailability(mc chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for device, online := range c.available {
+		v := 0.0
+		if online {
+			v = 1
+		}
+		collectConst(mc, c.availableDesc, prometheus.GaugeValue, v, device)
+	}
+}
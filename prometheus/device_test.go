@@ -0,0 +1,108 @@
+package prometheus
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+func TestCollector_Devices(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		TimestampMode:  "none",
+		TopicLabels:    config.TopicLabels{"device": 2},
+	}
+	c := NewCollector(time.Minute, []config.Metric{metric}, WithDevices(config.Devices{
+		Enabled:  true,
+		Label:    "device",
+		Timeout:  time.Minute,
+		Expected: []string{"sensor1", "sensor2"},
+	}))
+	before := time.Now()
+	c.Observe(metric, "/home/sensor1/temperature", 20, before, "/home/sensor1/temperature", "sensor1")
+	c.Observe(metric, "/home/sensor3/temperature", 20, before, "/home/sensor3/temperature", "sensor3")
+	// silent device is down after the timeout
+	c.(*memoryCachedCollector).devices.seen("sensor3", before.Add(-2*time.Minute))
+
+	got := gather(t, c)
+	for device, want := range map[string]float64{"sensor1": 1, "sensor2": 0, "sensor3": 0} {
+		if up := got["device_up|"+device]; up.value != want {
+			t.Errorf("device_up{device=%s} = %v, want %v", device, up.value, want)
+		}
+	}
+	if _, found := got["device_last_seen_timestamp_seconds|sensor2"]; found {
+		t.Errorf("never seen device has last seen timestamp")
+	}
+	if lastSeen := got["device_last_seen_timestamp_seconds|sensor1"].value; lastSeen < float64(before.Unix()) {
+		t.Errorf("last seen = %v, want after %v", lastSeen, before.Unix())
+	}
+}
+
+func TestCollector_DevicesRetention(t *testing.T) {
+	c := NewCollector(time.Minute, nil, WithDevices(config.Devices{
+		Enabled:   true,
+		Label:     "device",
+		Timeout:   time.Minute,
+		Retention: time.Hour,
+		Expected:  []string{"sensor1"},
+	}))
+	now := time.Now()
+	devices := c.(*memoryCachedCollector).devices
+	devices.seen("sensor1", now.Add(-2*time.Hour))
+	devices.seen("sensor2", now.Add(-2*time.Hour))
+	devices.seen("sensor3", now.Add(-30*time.Minute))
+
+	got := gather(t, c)
+	for device, want := range map[string]bool{"sensor1": true, "sensor2": false, "sensor3": true} {
+		if _, found := got["device_up|"+device]; found != want {
+			t.Errorf("device_up{device=%s} found = %v, want %v", device, found, want)
+		}
+	}
+	if _, found := devices.lastSeen["sensor2"]; found {
+		t.Errorf("device down longer than the retention is not forgotten")
+	}
+}
+
+func TestCollector_Availability(t *testing.T) {
+	power := config.Metric{
+		PrometheusName: "power_watts",
+		TimestampMode:  "none",
+		TopicLabels:    config.TopicLabels{"device": 1},
+	}
+	latency := config.Metric{
+		PrometheusName: "latency_seconds",
+		MetricType:     "histogram",
+		TimestampMode:  "none",
+		TopicLabels:    config.TopicLabels{"device": 1},
+	}
+	c := NewCollector(time.Minute, []config.Metric{power, latency}, WithDevices(config.Devices{Label: "device"}), WithAvailability())
+	c.Observe(power, "plugs/plug1/power", 100, time.Now(), "plugs/plug1/power", "plug1")
+	c.Observe(latency, "plugs/plug1/latency", 0.1, time.Now(), "plugs/plug1/latency", "plug1")
+	c.Observe(power, "plugs/plug2/power", 50, time.Now(), "plugs/plug2/power", "plug2")
+
+	c.ObserveAvailability("plug1", false, false)
+	c.ObserveAvailability("plug2", true, true)
+	got := gather(t, c)
+	if len(got) != 5 || got["device_available|plug1"].value != 0 || got["device_available|plug2"].value != 1 {
+		t.Errorf("Collect() = %v, want all series with plug1 unavailable", got)
+	}
+
+	c.ObserveAvailability("plug1", false, true)
+	got = gather(t, c)
+	want := map[string]sample{
+		"power_watts|plug2|plugs/plug2/power": {value: 50},
+		"device_available|plug1":              {value: 0},
+		"device_available|plug2":              {value: 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+
+	// removed histogram starts over
+	c.Observe(latency, "plugs/plug1/latency", 0.2, time.Now(), "plugs/plug1/latency", "plug1")
+	if s := gather(t, c)["latency_seconds|plug1|plugs/plug1/latency"]; s.count != 1 {
+		t.Errorf("histogram count = %v, want 1", s.count)
+	}
+}
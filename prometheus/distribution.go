@@ -0,0 +1,47 @@
+package prometheus
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+// Distribution is a histogram or summary aggregated by the publisher.
+type Distribution struct {
+	Count uint64
+	Sum   float64
+	// Buckets are cumulative counts by upper bound, without the +Inf bucket
+	Buckets map[float64]uint64
+	// Quantiles are values by quantile
+	Quantiles map[float64]float64
+}
+
+// distributionVec is a histogram or summary vector of a single metric.
+type distributionVec interface {
+	prometheus.ObserverVec
+	DeleteLabelValues(lvs ...string) bool
+}
+
+func newDistributionVec(metric config.Metric) distributionVec {
+	varLabels := metric.VariableLabels()
+
+	if metric.MetricType == "summary" {
+		objectives := make(map[float64]float64, len(metric.Objectives))
+		for _, o := range metric.Objectives {
+			objectives[o.Quantile] = o.Error
+		}
+		return prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name:        metric.PrometheusName,
+			Help:        metric.Help,
+			ConstLabels: metric.ConstantLabels,
+			Objectives:  objectives,
+			MaxAge:      metric.MaxAge,
+		}, varLabels)
+	}
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:                        metric.PrometheusName,
+		Help:                        metric.Help,
+		ConstLabels:                 metric.ConstantLabels,
+		Buckets:                     metric.Buckets,
+		NativeHistogramBucketFactor: metric.NativeFactor,
+	}, varLabels)
+}
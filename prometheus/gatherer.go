@@ -0,0 +1,41 @@
+package prometheus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// cachedGatherer reuses gathered metrics for scrapes within the time to live,
+// concurrent scrapes wait for the gathering in progress.
+type cachedGatherer struct {
+	gatherer prometheus.Gatherer
+	ttl      time.Duration
+
+	mu         sync.Mutex
+	gatheredAt time.Time
+	mfs        []*dto.MetricFamily
+	err        error
+}
+
+// NewCachedGatherer wraps gatherer to reuse gathered metrics for the time to live.
+// The gatherer is returned unchanged when ttl <= 0.
+func NewCachedGatherer(g prometheus.Gatherer, ttl time.Duration) prometheus.Gatherer {
+	if ttl <= 0 {
+		return g
+	}
+	return &cachedGatherer{gatherer: g, ttl: ttl}
+}
+
+func (g *cachedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.gatheredAt.IsZero() && time.Since(g.gatheredAt) < g.ttl {
+		return g.mfs, g.err
+	}
+	g.mfs, g.err = g.gatherer.Gather()
+	g.gatheredAt = time.Now()
+	return g.mfs, g.err
+}
@@ -0,0 +1,42 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type countingGatherer struct {
+	calls int
+}
+
+func (g *countingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.calls++
+	return nil, nil
+}
+
+func TestNewCachedGatherer(t *testing.T) {
+	g := &countingGatherer{}
+	if got := NewCachedGatherer(g, 0); got != prometheus.Gatherer(g) {
+		t.Errorf("NewCachedGatherer() = %v, want unchanged gatherer", got)
+	}
+
+	cg := NewCachedGatherer(g, 50*time.Millisecond)
+	for range 3 {
+		if _, err := cg.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.calls != 1 {
+		t.Errorf("calls = %v, want %v", g.calls, 1)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := cg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if g.calls != 2 {
+		t.Errorf("calls = %v, want %v", g.calls, 2)
+	}
+}
@@ -0,0 +1,197 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"github.com/torilabs/mqtt-prometheus-exporter/log"
+	"go.uber.org/zap"
+)
+
+// snapshot is collector state persisted across restarts.
+type snapshot struct {
+	Series   []seriesSnapshot           `json:"series"`
+	Counters map[string]counterSnapshot `json:"counters"`
+}
+
+type seriesSnapshot struct {
+	Name        string    `json:"name"`
+	LabelValues []string  `json:"label_values"`
+	Value       float64   `json:"value"`
+	Timestamp   time.Time `json:"timestamp"`
+	// Expires is zero for series which never expire
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+type counterSnapshot struct {
+	Last   float64 `json:"last"`
+	Offset float64 `json:"offset"`
+}
+
+// WithSnapshot is option that restores collector state from the snapshot file on startup
+// and writes it periodically and on close.
+func WithSnapshot(cfg config.Snapshot) CollectorOption {
+	return func(c *memoryCachedCollector) {
+		c.snapshot = cfg
+	}
+}
+
+// startSnapshots restores the snapshot and starts periodic writing of snapshots.
+func (c *memoryCachedCollector) startSnapshots(metrics []config.Metric) {
+	if c.snapshot.Path == "" {
+		return
+	}
+	if err := c.restoreSnapshot(metrics); err != nil {
+		log.Logger.With(zap.Error(err)).Warnf("Restoring of snapshot from '%s' failed.", c.snapshot.Path)
+	}
+	if c.snapshot.Interval <= 0 {
+		return
+	}
+	c.done = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(c.snapshot.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.writeSnapshot(); err != nil {
+					log.Logger.With(zap.Error(err)).Warnf("Writing of snapshot to '%s' failed.", c.snapshot.Path)
+				}
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops periodic snapshots and writes the final one.
+func (c *memoryCachedCollector) Close() error {
+	c.store.close()
+	if c.snapshot.Path == "" {
+		return nil
+	}
+	if c.done != nil {
+		close(c.done)
+	}
+	return c.writeSnapshot()
+}
+
+// writeSnapshot writes values of series and counter states to a temporary file replacing the snapshot.
+func (c *memoryCachedCollector) writeSnapshot() error {
+	snap := snapshot{Counters: make(map[string]counterSnapshot)}
+	for i := range c.store.shards {
+		sh := &c.store.shards[i]
+		sh.mu.RLock()
+		for key, st := range sh.counters {
+			snap.Counters[key] = counterSnapshot{Last: st.last, Offset: st.offset}
+		}
+		sh.mu.RUnlock()
+	}
+	c.store.each(func(_ string, item storeItem) {
+		entry := item.entry
+		if entry.name == "" {
+			return
+		}
+		s := seriesSnapshot{Name: entry.name, LabelValues: entry.labelValues, Value: entry.v, Timestamp: entry.ts}
+		if item.expires > 0 {
+			s.Expires = time.Unix(0, item.expires)
+		}
+		snap.Series = append(snap.Series, s)
+	})
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.snapshot.Path), filepath.Base(c.snapshot.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.snapshot.Path)
+}
+
+// restoreSnapshot restores series of configured gauges, counters and untyped metrics not expired yet.
+// Histograms, summaries, windows and derived metrics start over.
+func (c *memoryCachedCollector) restoreSnapshot(metrics []config.Metric) error {
+	data, err := os.ReadFile(c.snapshot.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("invalid snapshot: %w", err)
+	}
+
+	for key, st := range snap.Counters {
+		sh := c.store.shard(key)
+		sh.mu.Lock()
+		sh.counters[key] = &counterState{last: st.Last, offset: st.Offset}
+		sh.mu.Unlock()
+	}
+	now := time.Now()
+	restored := 0
+	for _, s := range snap.Series {
+		if !s.Expires.IsZero() && !s.Expires.After(now) {
+			continue
+		}
+		metric, found := snapshotMetric(metrics, s.Name)
+		if !found || metric.IsDistribution() {
+			continue
+		}
+		mi := c.info(metric)
+		if err := mi.validate(s.LabelValues); err != nil {
+			log.Logger.With(zap.Error(err)).Debugf("Skipping series of '%s' metric from snapshot.", s.Name)
+			continue
+		}
+		ttl := neverExpire
+		if !s.Expires.IsZero() {
+			ttl = s.Expires.Sub(now)
+		}
+		c.store.set(seriesKey(s.Name, s.LabelValues), &collectorEntry{
+			desc:        mi.desc,
+			valueType:   metric.PrometheusValueType(),
+			ts:          s.Timestamp,
+			noTimestamp: metric.TimestampPolicy() == "none",
+			v:           s.Value,
+			name:        s.Name,
+			labelValues: s.LabelValues,
+			labelNames:  mi.labelNames,
+			constLabels: metric.ConstantLabels,
+			device:      mi.device(s.LabelValues),
+		}, ttl)
+		restored++
+	}
+	log.Logger.Infof("Restored '%d' series from snapshot '%s'.", restored, c.snapshot.Path)
+	return nil
+}
+
+// snapshotMetric finds configuration of the series by its name, including metrics named by wildcard fields.
+func snapshotMetric(metrics []config.Metric, name string) (config.Metric, bool) {
+	for _, m := range metrics {
+		if m.PrometheusName == name {
+			return m, true
+		}
+		if m.HasWildcardField() && strings.HasPrefix(name, m.PrometheusName+"_") {
+			m.PrometheusName = name
+			return m, true
+		}
+	}
+	return config.Metric{}, false
+}
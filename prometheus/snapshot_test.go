@@ -0,0 +1,72 @@
+package prometheus
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+func TestCollector_Snapshot(t *testing.T) {
+	energy := config.Metric{PrometheusName: "energy_total", CounterMode: "cumulative", TopicLabels: config.TopicLabels{"meter": 2}}
+	power := config.Metric{PrometheusName: "power", TimestampMode: "none", Expiration: config.Expiration(30 * time.Millisecond)}
+	sensor := config.Metric{PrometheusName: "sensor", JSONField: "*", Expiration: config.NeverExpire}
+	metrics := []config.Metric{energy, power, sensor}
+	snap := config.Snapshot{Path: filepath.Join(t.TempDir(), "snapshot.json")}
+	ts := time.UnixMilli(1700000000000)
+
+	c := NewCollector(time.Minute, metrics, WithSnapshot(snap))
+	c.Observe(energy, "/meters/m1/energy", 100, ts, "/meters/m1/energy", "m1")
+	c.Observe(energy, "/meters/m1/energy", 5, ts.Add(time.Second), "/meters/m1/energy", "m1")
+	c.Observe(power, "/meters/m1/power", 50, ts, "/meters/m1/power")
+	dynamic := sensor
+	dynamic.PrometheusName = "sensor_temp"
+	c.Observe(dynamic, "/sensor", 21, ts, "/sensor")
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// power expires before the restart
+	time.Sleep(50 * time.Millisecond)
+	restored := NewCollector(time.Minute, metrics, WithSnapshot(snap))
+	want := map[string]sample{
+		"energy_total|m1|/meters/m1/energy": {value: 105, ts: 1700000001000},
+		"sensor_temp|/sensor":               {value: 21, ts: 1700000000000},
+	}
+	if got := gather(t, restored); !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+
+	// counter offset is restored
+	restored.Observe(energy, "/meters/m1/energy", 2, ts.Add(2*time.Second), "/meters/m1/energy", "m1")
+	if got := gather(t, restored)["energy_total|m1|/meters/m1/energy"]; got.value != 107 {
+		t.Errorf("energy = %v, want 107", got.value)
+	}
+}
+
+func TestCollector_SnapshotPeriodic(t *testing.T) {
+	metric := config.Metric{PrometheusName: "power"}
+	snap := config.Snapshot{Path: filepath.Join(t.TempDir(), "snapshot.json"), Interval: 10 * time.Millisecond}
+	c := NewCollector(time.Minute, []config.Metric{metric}, WithSnapshot(snap))
+	defer c.Close()
+	c.Observe(metric, "/power", 1, time.Now(), "/power")
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := os.Stat(snap.Path); err != nil {
+		t.Errorf("snapshot was not written: %v", err)
+	}
+}
+
+func TestCollector_SnapshotInvalid(t *testing.T) {
+	snap := config.Snapshot{Path: filepath.Join(t.TempDir(), "snapshot.json")}
+	if err := os.WriteFile(snap.Path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCollector(time.Minute, []config.Metric{{PrometheusName: "power"}}, WithSnapshot(snap))
+	if got := gather(t, c); len(got) != 0 {
+		t.Errorf("Collect() = %v, want no series", got)
+	}
+}
@@ -0,0 +1,105 @@
+package prometheus
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"github.com/torilabs/mqtt-prometheus-exporter/log"
+	"go.uber.org/zap"
+)
+
+// stateTracker tracks when the value of series changed and how long it stayed in every value.
+type stateTracker struct {
+	mu         sync.Mutex
+	value      float64
+	since      time.Time
+	lastChange time.Time
+	// seconds spent in every state by formatted value, the current state not included
+	seconds     map[string]float64
+	changeDesc  *prometheus.Desc
+	secondsDesc *prometheus.Desc
+}
+
+func newStateTracker(metric config.Metric) *stateTracker {
+	st := &stateTracker{seconds: make(map[string]float64)}
+	if metric.TrackChanges {
+		st.changeDesc = stateChangeDescription(metric)
+	}
+	if metric.TrackStates {
+		st.secondsDesc = stateSecondsDescription(metric)
+	}
+	return st
+}
+
+func stateChangeDescription(metric config.Metric) *prometheus.Desc {
+	return prometheus.NewDesc(
+		metric.PrometheusName+"_last_change_timestamp_seconds", metric.Help, metric.VariableLabels(), metric.ConstantLabels,
+	)
+}
+
+func stateSecondsDescription(metric config.Metric) *prometheus.Desc {
+	return prometheus.NewDesc(
+		metric.PrometheusName+"_state_seconds_total", metric.Help, append(metric.VariableLabels(), "state"), metric.ConstantLabels,
+	)
+}
+
+func (st *stateTracker) observe(v float64, ts time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.since.IsZero() {
+		st.value, st.since, st.lastChange = v, ts, ts
+		return
+	}
+	if ts.Before(st.since) {
+		return
+	}
+	st.seconds[formatState(st.value)] += ts.Sub(st.since).Seconds()
+	st.since = ts
+	if v != st.value {
+		st.value, st.lastChange = v, ts
+	}
+}
+
+// collect sends change timestamp and time spent in states, the current state is counted until now.
+func (st *stateTracker) collect(mc chan<- prometheus.Metric, now time.Time, labelValues []string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.changeDesc != nil {
+		collectConst(mc, st.changeDesc, prometheus.GaugeValue, float64(st.lastChange.UnixNano())/1e9, labelValues...)
+	}
+	if st.secondsDesc == nil {
+		return
+	}
+	current := formatState(st.value)
+	stateLabelValues := append(labelValues[:len(labelValues):len(labelValues)], "")
+	for state, seconds := range st.seconds {
+		if state == current {
+			continue
+		}
+		stateLabelValues[len(labelValues)] = state
+		collectConst(mc, st.secondsDesc, prometheus.CounterValue, seconds, stateLabelValues...)
+	}
+	seconds := st.seconds[current]
+	if now.After(st.since) {
+		seconds += now.Sub(st.since).Seconds()
+	}
+	stateLabelValues[len(labelValues)] = current
+	collectConst(mc, st.secondsDesc, prometheus.CounterValue, seconds, stateLabelValues...)
+}
+
+// collectConst sends constant metric, invalid metric is logged rather than failing the whole collection.
+func collectConst(mc chan<- prometheus.Metric, desc *prometheus.Desc, valueType prometheus.ValueType, v float64, labelValues ...string) {
+	m, err := prometheus.NewConstMetric(desc, valueType, v, labelValues...)
+	if err != nil {
+		log.Logger.With(zap.Error(err)).Warnf("Creation of prometheus metric failed.")
+		return
+	}
+	mc <- m
+}
+
+func formatState(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,200 @@
+package prometheus
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+const (
+	// storeShards is number of independently locked parts of the store.
+	storeShards = 64
+	// neverExpire is expiration of series kept until restart.
+	neverExpire time.Duration = -1
+)
+
+// store holds series by key in shards, so observations of different series do not contend.
+// Series expire after their expiration and are removed periodically by the janitor.
+type store struct {
+	seed       maphash.Seed
+	expiration time.Duration
+	shards     [storeShards]storeShard
+	onEvicted  func(key string, entry *collectorEntry)
+	done       chan struct{}
+}
+
+type storeShard struct {
+	mu    sync.RWMutex
+	items map[string]storeItem
+	// counters and states are kept outside of items to survive expiration
+	counters map[string]*counterState
+	states   map[string]*stateTracker
+}
+
+type storeItem struct {
+	entry *collectorEntry
+	// expires is unix nano time of expiration, zero for series which never expire
+	expires int64
+}
+
+// newStore creates store with default expiration of series, expiration <= 0 means no expiration.
+// Expired series are removed every cleanup interval, no janitor runs when the interval <= 0.
+func newStore(expiration, cleanupInterval time.Duration) *store {
+	s := &store{seed: maphash.MakeSeed(), expiration: expiration}
+	for i := range s.shards {
+		s.shards[i].items = make(map[string]storeItem)
+		s.shards[i].counters = make(map[string]*counterState)
+		s.shards[i].states = make(map[string]*stateTracker)
+	}
+	if cleanupInterval > 0 {
+		s.done = make(chan struct{})
+		go s.janitor(cleanupInterval)
+	}
+	return s
+}
+
+func (s *store) shard(key string) *storeShard {
+	return &s.shards[maphash.String(s.seed, key)%storeShards]
+}
+
+// expires resolves expiration time of series stored now, ttl 0 means the default expiration.
+func (s *store) expires(now time.Time, ttl time.Duration) int64 {
+	if ttl == 0 {
+		ttl = s.expiration
+	}
+	if ttl <= 0 {
+		return 0
+	}
+	return now.Add(ttl).UnixNano()
+}
+
+// get returns live series, the shard must be locked.
+func (sh *storeShard) get(key string, now int64) (storeItem, bool) {
+	item, found := sh.items[key]
+	if !found || (item.expires > 0 && item.expires <= now) {
+		return storeItem{}, false
+	}
+	return item, true
+}
+
+// counter returns state of the counter series, the shard must be locked.
+func (sh *storeShard) counter(key string) *counterState {
+	st, found := sh.counters[key]
+	if !found {
+		st = &counterState{}
+		sh.counters[key] = st
+	}
+	return st
+}
+
+// get returns live series with its expiration, zero for series which never expire.
+func (s *store) get(key string) (*collectorEntry, time.Time, bool) {
+	sh := s.shard(key)
+	sh.mu.RLock()
+	item, found := sh.get(key, time.Now().UnixNano())
+	sh.mu.RUnlock()
+	if !found {
+		return nil, time.Time{}, false
+	}
+	var expires time.Time
+	if item.expires > 0 {
+		expires = time.Unix(0, item.expires)
+	}
+	return item.entry, expires, true
+}
+
+// set stores series expiring after ttl, ttl 0 means the default expiration and negative ttl never expires.
+func (s *store) set(key string, entry *collectorEntry, ttl time.Duration) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	sh.items[key] = storeItem{entry: entry, expires: s.expires(time.Now(), ttl)}
+	sh.mu.Unlock()
+}
+
+// delete removes series and notifies about its eviction.
+func (s *store) delete(key string) {
+	sh := s.shard(key)
+	sh.mu.Lock()
+	item, found := sh.items[key]
+	delete(sh.items, key)
+	sh.mu.Unlock()
+	if found && s.onEvicted != nil {
+		s.onEvicted(key, item.entry)
+	}
+}
+
+// each calls fn for every live series. Shards are read locked one by one,
+// so fn must not modify the store.
+func (s *store) each(fn func(key string, item storeItem)) {
+	now := time.Now().UnixNano()
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		for key, item := range sh.items {
+			if item.expires > 0 && item.expires <= now {
+				continue
+			}
+			fn(key, item)
+		}
+		sh.mu.RUnlock()
+	}
+}
+
+// len returns number of stored series including expired series not removed yet.
+func (s *store) len() int {
+	n := 0
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		n += len(sh.items)
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// deleteExpired removes expired series and notifies about their eviction outside of the shard lock.
+func (s *store) deleteExpired() {
+	now := time.Now().UnixNano()
+	type evicted struct {
+		key   string
+		entry *collectorEntry
+	}
+	var all []evicted
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.Lock()
+		for key, item := range sh.items {
+			if item.expires > 0 && item.expires <= now {
+				delete(sh.items, key)
+				all = append(all, evicted{key: key, entry: item.entry})
+			}
+		}
+		sh.mu.Unlock()
+	}
+	if s.onEvicted == nil {
+		return
+	}
+	for _, e := range all {
+		s.onEvicted(e.key, e.entry)
+	}
+}
+
+func (s *store) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.deleteExpired()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// close stops the janitor.
+func (s *store) close() {
+	if s.done != nil {
+		close(s.done)
+	}
+}
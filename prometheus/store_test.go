@@ -0,0 +1,66 @@
+package prometheus
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestStore_Expiration(t *testing.T) {
+	s := newStore(50*time.Millisecond, time.Hour)
+	defer s.close()
+	var evicted []string
+	s.onEvicted = func(key string, _ *collectorEntry) {
+		evicted = append(evicted, key)
+	}
+	s.set("default", &collectorEntry{}, 0)
+	s.set("never", &collectorEntry{}, neverExpire)
+	s.set("long", &collectorEntry{}, time.Hour)
+
+	if _, expires, found := s.get("never"); !found || !expires.IsZero() {
+		t.Errorf("get() = %v, %v, want zero expiration", expires, found)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, _, found := s.get("default"); found {
+		t.Errorf("get() found expired series")
+	}
+	var live []string
+	s.each(func(key string, _ storeItem) {
+		live = append(live, key)
+	})
+	sort.Strings(live)
+	if want := []string{"long", "never"}; !reflect.DeepEqual(live, want) {
+		t.Errorf("each() = %v, want %v", live, want)
+	}
+
+	s.deleteExpired()
+	if want := []string{"default"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted = %v, want %v", evicted, want)
+	}
+	if got := s.len(); got != 2 {
+		t.Errorf("len() = %v, want %v", got, 2)
+	}
+	s.delete("never")
+	if want := []string{"default", "never"}; !reflect.DeepEqual(evicted, want) {
+		t.Errorf("evicted = %v, want %v", evicted, want)
+	}
+}
+
+func Test_seriesKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		labelValues []string
+		want        string
+	}{
+		{name: "temperature", labelValues: []string{"/home", "kitchen"}, want: "temperature|5:/home|7:kitchen"},
+		{name: "temperature", labelValues: []string{"x|y", "z"}, want: "temperature|3:x|y|1:z"},
+		{name: "temperature", labelValues: []string{"x", "y|z"}, want: "temperature|1:x|3:y|z"},
+		{name: "temperature", labelValues: nil, want: "temperature"},
+	}
+	for _, tt := range tests {
+		if got := seriesKey(tt.name, tt.labelValues); got != tt.want {
+			t.Errorf("seriesKey() = %v, want %v", got, tt.want)
+		}
+	}
+}
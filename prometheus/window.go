@@ -0,0 +1,125 @@
+package prometheus
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+// windowSlots is number of sub-intervals the sliding window is approximated with.
+const windowSlots = 10
+
+var aggregationFunctions = map[string]bool{"min": true, "max": true, "avg": true, "last": true, "count": true}
+
+// IsAggregationFunction checks if the function is supported by windowed aggregations.
+func IsAggregationFunction(function string) bool {
+	return aggregationFunctions[function]
+}
+
+// AggregationName constructs name of the series aggregated over the window, e.g. "temperature_max_1m".
+func AggregationName(name, function string, window time.Duration) string {
+	w := window.String()
+	if strings.HasSuffix(w, "m0s") {
+		w = strings.TrimSuffix(w, "0s")
+	}
+	if strings.HasSuffix(w, "h0m") {
+		w = strings.TrimSuffix(w, "0m")
+	}
+	return name + "_" + function + "_" + strings.ReplaceAll(w, ".", "_")
+}
+
+type windowSlot struct {
+	idx      int64
+	min, max float64
+	sum      float64
+	count    uint64
+}
+
+// slidingWindow aggregates values incrementally into slots, so reading it does not depend on the message rate.
+type slidingWindow struct {
+	mu     sync.Mutex
+	width  int64
+	slots  [windowSlots]windowSlot
+	last   float64
+	lastTs time.Time
+	descs  map[string]*prometheus.Desc
+}
+
+func newSlidingWindows(metric config.Metric) []*slidingWindow {
+	windows := make([]*slidingWindow, 0, len(metric.Aggregations))
+	for _, a := range metric.Aggregations {
+		w := &slidingWindow{
+			width: max(int64(a.Window)/windowSlots, 1),
+			descs: make(map[string]*prometheus.Desc, len(a.Functions)),
+		}
+		for _, fn := range a.Functions {
+			w.descs[fn] = aggregationDescription(metric, fn, a.Window)
+		}
+		windows = append(windows, w)
+	}
+	return windows
+}
+
+func aggregationDescription(metric config.Metric, function string, window time.Duration) *prometheus.Desc {
+	return prometheus.NewDesc(
+		AggregationName(metric.PrometheusName, function, window), metric.Help, metric.VariableLabels(), metric.ConstantLabels,
+	)
+}
+
+func (w *slidingWindow) observe(v float64, ts time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	idx := ts.UnixNano() / w.width
+	s := &w.slots[idx%windowSlots]
+	if s.idx != idx || s.count == 0 {
+		*s = windowSlot{idx: idx, min: v, max: v}
+	}
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+	s.sum += v
+	s.count++
+	if !ts.Before(w.lastTs) {
+		w.last, w.lastTs = v, ts
+	}
+}
+
+// collect sends aggregations of values received within the window ending at now.
+func (w *slidingWindow) collect(mc chan<- prometheus.Metric, now time.Time, labelValues []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	nowIdx := now.UnixNano() / w.width
+	agg := windowSlot{min: math.Inf(1), max: math.Inf(-1)}
+	for _, s := range w.slots {
+		if s.count == 0 || nowIdx-s.idx >= windowSlots {
+			continue
+		}
+		agg.min = math.Min(agg.min, s.min)
+		agg.max = math.Max(agg.max, s.max)
+		agg.sum += s.sum
+		agg.count += s.count
+	}
+	for fn, desc := range w.descs {
+		var v float64
+		switch fn {
+		case "count":
+			v = float64(agg.count)
+		case "min":
+			v = agg.min
+		case "max":
+			v = agg.max
+		case "avg":
+			v = agg.sum / float64(agg.count)
+		case "last":
+			v = w.last
+		}
+		if agg.count == 0 && fn != "count" {
+			// no value was received within the window
+			continue
+		}
+		collectConst(mc, desc, prometheus.GaugeValue, v, labelValues...)
+	}
+}
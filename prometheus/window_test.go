@@ -0,0 +1,46 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+func TestAggregationName(t *testing.T) {
+	tests := []struct {
+		window time.Duration
+		want   string
+	}{
+		{window: time.Minute, want: "temperature_max_1m"},
+		{window: 90 * time.Second, want: "temperature_max_1m30s"},
+		{window: time.Hour, want: "temperature_max_1h"},
+		{window: 30 * time.Second, want: "temperature_max_30s"},
+		{window: 1500 * time.Millisecond, want: "temperature_max_1_5s"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := AggregationName("temperature", "max", tt.window); got != tt.want {
+				t.Errorf("AggregationName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlidingWindow_InvalidDescription(t *testing.T) {
+	metric := config.Metric{
+		PrometheusName: "temperature",
+		TopicLabels:    config.TopicLabels{"topic": 1},
+		Aggregations:   []config.Aggregation{{Window: time.Minute, Functions: []string{"max"}}},
+	}
+	now := time.Now()
+	w := newSlidingWindows(metric)[0]
+	w.observe(21, now)
+
+	mc := make(chan prometheus.Metric, 10)
+	w.collect(mc, now, []string{"/home/kitchen", "kitchen"})
+	if len(mc) != 0 {
+		t.Errorf("collect() sent %v metrics, want 0", len(mc))
+	}
+}
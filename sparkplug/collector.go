@@ -0,0 +1,261 @@
+package sparkplug
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	pahomqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+	"github.com/torilabs/mqtt-prometheus-exporter/log"
+	"go.uber.org/zap"
+)
+
+// Namespace is the Sparkplug B topic namespace.
+const Namespace = "spBv1.0"
+
+const bdSeqMetric = "bdSeq"
+
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// Collector decodes Sparkplug B messages and exports contained metrics.
+type Collector interface {
+	prometheus.Collector
+	Handle(client pahomqtt.Client, msg pahomqtt.Message)
+}
+
+type nodeKey struct {
+	group string
+	node  string
+}
+
+type seriesKey struct {
+	device string
+	name   string
+}
+
+type series struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     float64
+	ts        time.Time
+}
+
+type edgeNode struct {
+	bdSeq   *float64
+	aliases map[uint64]seriesKey
+	births  map[seriesKey]DataType
+	series  map[seriesKey]*series
+}
+
+type sparkplugCollector struct {
+	cfg   config.Sparkplug
+	mu    sync.Mutex
+	nodes map[nodeKey]*edgeNode
+	descs map[string]*prometheus.Desc
+}
+
+// NewCollector constructs collector of Sparkplug B metrics.
+func NewCollector(cfg config.Sparkplug) Collector {
+	return &sparkplugCollector{
+		cfg:   cfg,
+		nodes: make(map[nodeKey]*edgeNode),
+		descs: make(map[string]*prometheus.Desc),
+	}
+}
+
+// Topic returns subscription topic of all Sparkplug B messages in the group.
+func Topic(groupID string) string {
+	return fmt.Sprintf("%s/%s/#", Namespace, groupID)
+}
+
+func newEdgeNode() *edgeNode {
+	return &edgeNode{
+		aliases: make(map[uint64]seriesKey),
+		births:  make(map[seriesKey]DataType),
+		series:  make(map[seriesKey]*series),
+	}
+}
+
+func (c *sparkplugCollector) Handle(_ pahomqtt.Client, msg pahomqtt.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) < 4 || len(parts) > 5 || parts[0] != Namespace {
+		log.Logger.Debugf("Ignoring non Sparkplug B message from '%s' topic.", msg.Topic())
+		return
+	}
+	key := nodeKey{group: parts[1], node: parts[3]}
+	msgType := parts[2]
+	device := ""
+	if len(parts) == 5 {
+		device = parts[4]
+	}
+
+	switch msgType {
+	case "NBIRTH", "DBIRTH", "NDATA", "DDATA", "NDEATH", "DDEATH":
+	default:
+		log.Logger.Debugf("Ignoring Sparkplug B '%s' message from '%s' topic.", msgType, msg.Topic())
+		return
+	}
+
+	payload, err := DecodePayload(msg.Payload())
+	if err != nil {
+		log.Logger.With(zap.Error(err)).Warnf("Got an invalid Sparkplug B payload from '%s' topic.", msg.Topic())
+		return
+	}
+	log.Logger.Debugf("Received Sparkplug B '%s' message with %d metrics from '%s' topic.", msgType, len(payload.Metrics), msg.Topic())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch msgType {
+	case "NBIRTH":
+		n := newEdgeNode()
+		c.nodes[key] = n
+		c.birth(key, n, "", payload)
+	case "DBIRTH":
+		n := c.node(key)
+		n.removeDevice(device)
+		c.birth(key, n, device, payload)
+	case "NDATA", "DDATA":
+		n := c.node(key)
+		for i := range payload.Metrics {
+			c.record(key, n, device, payload, &payload.Metrics[i])
+		}
+	case "NDEATH":
+		n, ok := c.nodes[key]
+		if !ok {
+			return
+		}
+		if bdSeq, found := findBdSeq(payload); found && n.bdSeq != nil && *n.bdSeq != bdSeq {
+			log.Logger.Debugf("Ignoring stale NDEATH of edge node '%s/%s'.", key.group, key.node)
+			return
+		}
+		delete(c.nodes, key)
+	case "DDEATH":
+		if n, ok := c.nodes[key]; ok {
+			n.removeDevice(device)
+		}
+	}
+}
+
+func (c *sparkplugCollector) node(key nodeKey) *edgeNode {
+	n, ok := c.nodes[key]
+	if !ok {
+		n = newEdgeNode()
+		c.nodes[key] = n
+	}
+	return n
+}
+
+func (c *sparkplugCollector) birth(key nodeKey, n *edgeNode, device string, payload *Payload) {
+	for i := range payload.Metrics {
+		m := &payload.Metrics[i]
+		if m.Name == "" {
+			continue
+		}
+		sk := seriesKey{device: device, name: m.Name}
+		n.births[sk] = m.DataType
+		if m.HasAlias {
+			n.aliases[m.Alias] = sk
+		}
+		if device == "" && m.Name == bdSeqMetric {
+			if v, ok := m.Value(); ok {
+				n.bdSeq = &v
+			}
+		}
+		c.record(key, n, device, payload, m)
+	}
+}
+
+func (c *sparkplugCollector) record(key nodeKey, n *edgeNode, device string, payload *Payload, m *Metric) {
+	sk := seriesKey{device: device, name: m.Name}
+	if m.Name == "" {
+		aliased, ok := n.aliases[m.Alias]
+		if !m.HasAlias || !ok {
+			log.Logger.Warnf("Got Sparkplug B metric with unknown alias '%d' from edge node '%s/%s'.", m.Alias, key.group, key.node)
+			return
+		}
+		sk = aliased
+	}
+	if m.DataType == 0 {
+		m.DataType = n.births[sk]
+	}
+	v, ok := m.Value()
+	if !ok {
+		return
+	}
+
+	ts := time.Now()
+	if m.Timestamp > 0 {
+		ts = time.UnixMilli(int64(m.Timestamp))
+	} else if payload.Timestamp > 0 {
+		ts = time.UnixMilli(int64(payload.Timestamp))
+	}
+
+	n.series[sk] = &series{
+		desc:      c.description(sk.name),
+		valueType: c.valueType(m.DataType),
+		value:     v,
+		ts:        ts,
+	}
+}
+
+func (c *sparkplugCollector) description(name string) *prometheus.Desc {
+	promName := c.cfg.Prefix + "_" + invalidNameChars.ReplaceAllString(name, "_")
+	if d, ok := c.descs[promName]; ok {
+		return d
+	}
+	d := prometheus.NewDesc(
+		promName, fmt.Sprintf("Sparkplug B metric '%s'.", name), []string{"group", "edge_node", "device"}, nil,
+	)
+	c.descs[promName] = d
+	return d
+}
+
+func (c *sparkplugCollector) valueType(dt DataType) prometheus.ValueType {
+	for k, v := range c.cfg.Types {
+		if strings.EqualFold(k, dt.String()) && v == "counter" {
+			return prometheus.CounterValue
+		}
+	}
+	return prometheus.GaugeValue
+}
+
+func (n *edgeNode) removeDevice(device string) {
+	for sk := range n.series {
+		if sk.device == device {
+			delete(n.series, sk)
+		}
+	}
+}
+
+func findBdSeq(payload *Payload) (float64, bool) {
+	for i := range payload.Metrics {
+		if payload.Metrics[i].Name == bdSeqMetric {
+			return payload.Metrics[i].Value()
+		}
+	}
+	return 0, false
+}
+
+// Describe sends no descriptions as Sparkplug B metrics are known only after birth certificates arrive.
+func (c *sparkplugCollector) Describe(chan<- *prometheus.Desc) {
+}
+
+func (c *sparkplugCollector) Collect(mc chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, n := range c.nodes {
+		for sk, s := range n.series {
+			m, err := prometheus.NewConstMetric(s.desc, s.valueType, s.value, key.group, key.node, sk.device)
+			if err != nil {
+				log.Logger.With(zap.Error(err)).Warnf("Creation of prometheus metric failed.")
+				continue
+			}
+			mc <- prometheus.NewMetricWithTimestamp(s.ts, m)
+		}
+	}
+}
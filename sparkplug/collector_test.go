@@ -0,0 +1,155 @@
+package sparkplug
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/torilabs/mqtt-prometheus-exporter/config"
+)
+
+type fakeMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *fakeMessage) Duplicate() bool {
+	return false
+}
+
+func (m *fakeMessage) Qos() byte {
+	return 0
+}
+
+func (m *fakeMessage) Retained() bool {
+	return false
+}
+
+func (m *fakeMessage) Topic() string {
+	return m.topic
+}
+
+func (m *fakeMessage) MessageID() uint16 {
+	return 0
+}
+
+func (m *fakeMessage) Payload() []byte {
+	return m.payload
+}
+
+func (m *fakeMessage) Ack() {
+}
+
+type sample struct {
+	value     float64
+	valueType dto.MetricType
+}
+
+func gather(t *testing.T, c prometheus.Collector) map[string]sample {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(c)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]sample)
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			key := mf.GetName()
+			for _, lp := range m.GetLabel() {
+				key += "|" + lp.GetValue()
+			}
+			s := sample{valueType: mf.GetType()}
+			if mf.GetType() == dto.MetricType_COUNTER {
+				s.value = m.GetCounter().GetValue()
+			} else {
+				s.value = m.GetGauge().GetValue()
+			}
+			got[key] = s
+		}
+	}
+	return got
+}
+
+func TestCollector_Lifecycle(t *testing.T) {
+	c := NewCollector(config.Sparkplug{Prefix: "spb", Types: map[string]string{"uint64": "counter"}})
+	handle := func(topic string, payload []byte) {
+		c.Handle(nil, &fakeMessage{topic: topic, payload: payload})
+	}
+
+	handle("spBv1.0/plant/NBIRTH/edge1", encodePayload(1000,
+		testMetric{name: "bdSeq", dataType: UInt64, value: uint64(3)},
+		testMetric{name: "Node Control/Rebirth", alias: 1, hasAlias: true, dataType: Boolean, value: false},
+		testMetric{name: "uptime", alias: 2, hasAlias: true, dataType: Int32, value: int32(10)},
+	))
+	handle("spBv1.0/plant/DBIRTH/edge1/meter1", encodePayload(1000,
+		testMetric{name: "energy", alias: 10, hasAlias: true, dataType: UInt64, value: uint64(100)},
+		testMetric{name: "temperature", alias: 11, hasAlias: true, dataType: Float, value: float32(20.5)},
+	))
+	handle("spBv1.0/plant/DBIRTH/edge1/meter2", encodePayload(1000,
+		testMetric{name: "energy", alias: 20, hasAlias: true, dataType: UInt64, value: uint64(7)},
+	))
+	handle("spBv1.0/plant/DDATA/edge1/meter1", encodePayload(2000,
+		testMetric{alias: 10, hasAlias: true, value: uint64(150)},
+		testMetric{alias: 11, hasAlias: true, value: float32(21)},
+	))
+	handle("spBv1.0/plant/NDATA/edge1", encodePayload(2000,
+		testMetric{alias: 2, hasAlias: true, value: int32(20)},
+		testMetric{alias: 99, hasAlias: true, value: int32(1)},
+	))
+
+	want := map[string]sample{
+		"spb_bdSeq||edge1|plant":                {value: 3, valueType: dto.MetricType_COUNTER},
+		"spb_Node_Control_Rebirth||edge1|plant": {value: 0, valueType: dto.MetricType_GAUGE},
+		"spb_uptime||edge1|plant":               {value: 20, valueType: dto.MetricType_GAUGE},
+		"spb_energy|meter1|edge1|plant":         {value: 150, valueType: dto.MetricType_COUNTER},
+		"spb_energy|meter2|edge1|plant":         {value: 7, valueType: dto.MetricType_COUNTER},
+		"spb_temperature|meter1|edge1|plant":    {value: 21, valueType: dto.MetricType_GAUGE},
+	}
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("after data got %v, want %v", got, want)
+	}
+
+	handle("spBv1.0/plant/DDEATH/edge1/meter1", encodePayload(3000))
+	delete(want, "spb_energy|meter1|edge1|plant")
+	delete(want, "spb_temperature|meter1|edge1|plant")
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("after DDEATH got %v, want %v", got, want)
+	}
+
+	// NDEATH of a previous session must not remove series of the current one
+	handle("spBv1.0/plant/NDEATH/edge1", encodePayload(0,
+		testMetric{name: "bdSeq", dataType: UInt64, value: uint64(2)},
+	))
+	if got := gather(t, c); !reflect.DeepEqual(got, want) {
+		t.Errorf("after stale NDEATH got %v, want %v", got, want)
+	}
+
+	handle("spBv1.0/plant/NDEATH/edge1", encodePayload(0,
+		testMetric{name: "bdSeq", dataType: UInt64, value: uint64(3)},
+	))
+	if got := gather(t, c); len(got) != 0 {
+		t.Errorf("after NDEATH got %v, want no series", got)
+	}
+}
+
+func TestCollector_IgnoredMessages(t *testing.T) {
+	c := NewCollector(config.Sparkplug{Prefix: "spb"})
+	payload := encodePayload(1000, testMetric{name: "temp", dataType: Double, value: 1.5})
+
+	c.Handle(nil, &fakeMessage{topic: "spBv1.0/STATE/host", payload: payload})
+	c.Handle(nil, &fakeMessage{topic: "spBv1.0/plant/NCMD/edge1", payload: payload})
+	c.Handle(nil, &fakeMessage{topic: "other/plant/NDATA/edge1", payload: payload})
+	c.Handle(nil, &fakeMessage{topic: "spBv1.0/plant/NDATA/edge1", payload: []byte{0x80}})
+
+	if got := gather(t, c); len(got) != 0 {
+		t.Errorf("got %v, want no series", got)
+	}
+}
+
+func TestTopic(t *testing.T) {
+	if got := Topic("+"); got != "spBv1.0/+/#" {
+		t.Errorf("Topic() = %v", got)
+	}
+}
@@ -0,0 +1,195 @@
+package sparkplug
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// DataType is a Sparkplug B metric datatype.
+type DataType uint32
+
+// Sparkplug B datatypes which can be exported as prometheus metrics.
+const (
+	Int8     DataType = 1
+	Int16    DataType = 2
+	Int32    DataType = 3
+	Int64    DataType = 4
+	UInt8    DataType = 5
+	UInt16   DataType = 6
+	UInt32   DataType = 7
+	UInt64   DataType = 8
+	Float    DataType = 9
+	Double   DataType = 10
+	Boolean  DataType = 11
+	String   DataType = 12
+	DateTime DataType = 13
+)
+
+var dataTypeNames = map[DataType]string{
+	Int8:     "Int8",
+	Int16:    "Int16",
+	Int32:    "Int32",
+	Int64:    "Int64",
+	UInt8:    "UInt8",
+	UInt16:   "UInt16",
+	UInt32:   "UInt32",
+	UInt64:   "UInt64",
+	Float:    "Float",
+	Double:   "Double",
+	Boolean:  "Boolean",
+	String:   "String",
+	DateTime: "DateTime",
+}
+
+func (dt DataType) String() string {
+	if name, ok := dataTypeNames[dt]; ok {
+		return name
+	}
+	return fmt.Sprintf("DataType(%d)", uint32(dt))
+}
+
+// Payload is the subset of Sparkplug B payload needed for metric export.
+type Payload struct {
+	Timestamp uint64
+	Seq       uint64
+	Metrics   []Metric
+}
+
+// Metric is a single Sparkplug B metric of a payload.
+type Metric struct {
+	Name      string
+	Alias     uint64
+	HasAlias  bool
+	Timestamp uint64
+	DataType  DataType
+	IsNull    bool
+
+	intValue    uint32
+	longValue   uint64
+	floatValue  float32
+	doubleValue float64
+	boolValue   bool
+	hasValue    bool
+}
+
+// Value converts metric value to float according to its datatype.
+func (m *Metric) Value() (float64, bool) {
+	if m.IsNull || !m.hasValue {
+		return 0, false
+	}
+	switch m.DataType {
+	case Int8, Int16, Int32:
+		return float64(int32(m.intValue)), true
+	case UInt8, UInt16, UInt32:
+		return float64(m.intValue), true
+	case Int64:
+		return float64(int64(m.longValue)), true
+	case UInt64:
+		return float64(m.longValue), true
+	case Float:
+		return float64(m.floatValue), true
+	case Double:
+		return m.doubleValue, true
+	case Boolean:
+		if m.boolValue {
+			return 1, true
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// DecodePayload decodes Sparkplug B protobuf payload.
+// Fields not relevant for metric export are skipped.
+func DecodePayload(b []byte) (*Payload, error) {
+	p := &Payload{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			p.Timestamp, n = protowire.ConsumeVarint(b)
+		case num == 2 && typ == protowire.BytesType:
+			var raw []byte
+			raw, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				m, err := decodeMetric(raw)
+				if err != nil {
+					return nil, fmt.Errorf("invalid metric: %w", err)
+				}
+				p.Metrics = append(p.Metrics, m)
+			}
+		case num == 3 && typ == protowire.VarintType:
+			p.Seq, n = protowire.ConsumeVarint(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return p, nil
+}
+
+func decodeMetric(b []byte) (Metric, error) {
+	m := Metric{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+		var v uint64
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var raw []byte
+			raw, n = protowire.ConsumeBytes(b)
+			m.Name = string(raw)
+		case num == 2 && typ == protowire.VarintType:
+			m.Alias, n = protowire.ConsumeVarint(b)
+			m.HasAlias = true
+		case num == 3 && typ == protowire.VarintType:
+			m.Timestamp, n = protowire.ConsumeVarint(b)
+		case num == 4 && typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			m.DataType = DataType(v)
+		case num == 7 && typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			m.IsNull = v != 0
+		case num == 10 && typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			m.intValue = uint32(v)
+			m.hasValue = true
+		case num == 11 && typ == protowire.VarintType:
+			m.longValue, n = protowire.ConsumeVarint(b)
+			m.hasValue = true
+		case num == 12 && typ == protowire.Fixed32Type:
+			var f uint32
+			f, n = protowire.ConsumeFixed32(b)
+			m.floatValue = math.Float32frombits(f)
+			m.hasValue = true
+		case num == 13 && typ == protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+			m.doubleValue = math.Float64frombits(v)
+			m.hasValue = true
+		case num == 14 && typ == protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+			m.boolValue = v != 0
+			m.hasValue = true
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return m, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return m, nil
+}
@@ -0,0 +1,151 @@
+package sparkplug
+
+import (
+	"math"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type testMetric struct {
+	name     string
+	alias    uint64
+	hasAlias bool
+	ts       uint64
+	dataType DataType
+	isNull   bool
+	value    interface{}
+}
+
+func encodeMetric(m testMetric) []byte {
+	var b []byte
+	if m.name != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.name)
+	}
+	if m.hasAlias {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.alias)
+	}
+	if m.ts > 0 {
+		b = protowire.AppendTag(b, 3, protowire.VarintType)
+		b = protowire.AppendVarint(b, m.ts)
+	}
+	if m.dataType > 0 {
+		b = protowire.AppendTag(b, 4, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(m.dataType))
+	}
+	if m.isNull {
+		b = protowire.AppendTag(b, 7, protowire.VarintType)
+		b = protowire.AppendVarint(b, 1)
+	}
+	switch v := m.value.(type) {
+	case int32:
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(uint32(v)))
+	case uint32:
+		b = protowire.AppendTag(b, 10, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case int64:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(v))
+	case uint64:
+		b = protowire.AppendTag(b, 11, protowire.VarintType)
+		b = protowire.AppendVarint(b, v)
+	case float32:
+		b = protowire.AppendTag(b, 12, protowire.Fixed32Type)
+		b = protowire.AppendFixed32(b, math.Float32bits(v))
+	case float64:
+		b = protowire.AppendTag(b, 13, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(v))
+	case bool:
+		b = protowire.AppendTag(b, 14, protowire.VarintType)
+		b = protowire.AppendVarint(b, protowire.EncodeBool(v))
+	case string:
+		b = protowire.AppendTag(b, 15, protowire.BytesType)
+		b = protowire.AppendString(b, v)
+	}
+	return b
+}
+
+func encodePayload(ts uint64, metrics ...testMetric) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, ts)
+	for _, m := range metrics {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeMetric(m))
+	}
+	b = protowire.AppendTag(b, 3, protowire.VarintType)
+	b = protowire.AppendVarint(b, 7)
+	// uuid field is skipped by decoder
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendString(b, "uuid")
+	return b
+}
+
+func TestDecodePayload(t *testing.T) {
+	b := encodePayload(1700000000000,
+		testMetric{name: "Node Control/Rebirth", alias: 1, hasAlias: true, dataType: Boolean, value: true},
+		testMetric{name: "temp", alias: 2, hasAlias: true, ts: 1700000000500, dataType: Float, value: float32(21.5)},
+		testMetric{alias: 3, hasAlias: true, dataType: Int16, value: int32(-12)},
+		testMetric{name: "energy", dataType: UInt64, value: uint64(1 << 40)},
+		testMetric{name: "offset", dataType: Int64, value: int64(-5)},
+		testMetric{name: "pressure", dataType: Double, value: 1.25},
+		testMetric{name: "label", dataType: String, value: "text"},
+		testMetric{name: "missing", dataType: Double, isNull: true},
+	)
+
+	p, err := DecodePayload(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Timestamp != 1700000000000 || p.Seq != 7 || len(p.Metrics) != 8 {
+		t.Fatalf("DecodePayload() = %+v", p)
+	}
+
+	tests := []struct {
+		idx    int
+		want   float64
+		wantOk bool
+	}{
+		{idx: 0, want: 1, wantOk: true},
+		{idx: 1, want: 21.5, wantOk: true},
+		{idx: 2, want: -12, wantOk: true},
+		{idx: 3, want: 1 << 40, wantOk: true},
+		{idx: 4, want: -5, wantOk: true},
+		{idx: 5, want: 1.25, wantOk: true},
+		{idx: 6, want: 0, wantOk: false},
+		{idx: 7, want: 0, wantOk: false},
+	}
+	for _, tt := range tests {
+		m := p.Metrics[tt.idx]
+		if got, ok := m.Value(); got != tt.want || ok != tt.wantOk {
+			t.Errorf("metric %d Value() = (%v, %v), want (%v, %v)", tt.idx, got, ok, tt.want, tt.wantOk)
+		}
+	}
+	if p.Metrics[1].Name != "temp" || p.Metrics[1].Alias != 2 || p.Metrics[1].Timestamp != 1700000000500 {
+		t.Errorf("metric 1 = %+v", p.Metrics[1])
+	}
+	if p.Metrics[2].Name != "" || !p.Metrics[2].HasAlias || p.Metrics[3].HasAlias {
+		t.Errorf("aliases decoded incorrectly: %+v, %+v", p.Metrics[2], p.Metrics[3])
+	}
+}
+
+func TestDecodePayload_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "truncated tag", payload: []byte{0x80}},
+		{name: "truncated metric", payload: []byte{0x12, 0x05, 0x0a}},
+		{name: "invalid metric content", payload: []byte{0x12, 0x01, 0x80}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodePayload(tt.payload); err == nil {
+				t.Errorf("DecodePayload() expected error")
+			}
+		})
+	}
+}